@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// alias points alias at actual. The caller must hold c's lock.
+func (c *commands) alias(alias, actual string) {
+	c.aliases[alias] = actual
+	c.rAliases[actual] = append(c.rAliases[actual], alias)
+}
+
+// unalias removes an alias. The caller must hold c's lock.
+func (c *commands) unalias(alias string) {
+	actual, ok := c.aliases[alias]
+	if !ok {
+		return
+	}
+	delete(c.aliases, alias)
+	r := c.rAliases[actual][:0]
+	for _, a := range c.rAliases[actual] {
+		if a != alias {
+			r = append(r, a)
+		}
+	}
+	if len(r) == 0 {
+		delete(c.rAliases, actual)
+	} else {
+		c.rAliases[actual] = r
+	}
+}
+
+func cmdAlias(ch *channel, _ *User, data string) string {
+	const usage = "Usage: !alias add <alias> <command>, !alias remove <alias> or !alias list"
+	v := split(data, 3)
+	action := v[0]
+	alias := strings.TrimPrefix(strings.ToLower(v[1]), "!")
+	target := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(v[2])), "!")
+
+	ch.cmds.Lock()
+	defer ch.cmds.Unlock()
+
+	switch action {
+	case "add":
+		if alias == "" || target == "" {
+			return usage
+		}
+		if _, ok := ch.cmds.cmds[alias]; ok {
+			return fmt.Sprintf("!%s is already a command", alias)
+		}
+		if actual, ok := ch.cmds.aliases[alias]; ok {
+			return fmt.Sprintf("!%s is already an alias for !%s", alias, actual)
+		}
+		target = ch.cmds.resolve(target)
+		if _, ok := ch.cmds.cmds[target]; !ok {
+			return fmt.Sprintf("!%s isn't a command", target)
+		}
+		if err := ch.cmds.aliasStore.Add(alias, target); err != nil {
+			return errSaving(err)
+		}
+		ch.cmds.alias(alias, target)
+		return fmt.Sprintf("!%s now runs !%s", alias, target)
+
+	case "remove", "del", "delete":
+		if alias == "" {
+			return usage
+		}
+		if _, ok := ch.cmds.aliases[alias]; !ok {
+			return fmt.Sprintf("!%s isn't an alias", alias)
+		}
+		if _, ok := ch.cmds.aliasStore.Get(alias); !ok {
+			return "I'm afraid I can't remove a built in alias"
+		}
+		if err := ch.cmds.aliasStore.Remove(alias); err != nil {
+			return errSaving(err)
+		}
+		ch.cmds.unalias(alias)
+		return fmt.Sprintf("Removed alias !%s", alias)
+
+	case "list":
+		pairs := []string{}
+		for a, actual := range ch.cmds.aliases {
+			pairs = append(pairs, fmt.Sprintf("!%s -> !%s", a, actual))
+		}
+		if len(pairs) == 0 {
+			return "No aliases"
+		}
+		sort.Strings(pairs)
+		return "Aliases: " + strings.Join(pairs, ", ")
+	}
+
+	return usage
+}
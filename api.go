@@ -7,9 +7,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"hash"
+	"html/template"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"time"
 )
@@ -17,12 +19,47 @@ import (
 func init() {
 	http.HandleFunc("/", home)
 	http.HandleFunc("/_github", githubWebhook)
+	http.HandleFunc("/commands", commandList)
 }
 
 func home(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Welcome Home")
 }
 
+var commandListTemplate = template.Must(template.New("commands").Parse(`<!doctype html>
+<title>kaet commands</title>
+{{range .}}
+<h2>#{{.Name}}</h2>
+<table>
+<tr><th>Command</th><th>Usage</th><th>Description</th><th>Who can use it</th><th>Aliases</th></tr>
+{{range .Commands}}<tr><td>!{{.Name}}</td><td>{{.Usage}}</td><td>{{.Description}}</td><td>{{.Level}}</td><td>{{range .Aliases}}!{{.}} {{end}}</td></tr>
+{{end}}</table>
+{{end}}`))
+
+func commandList(w http.ResponseWriter, r *http.Request) {
+	type channelCommands struct {
+		Name     string
+		Commands []commandInfo
+	}
+
+	filter := strings.ToLower(strings.TrimPrefix(r.URL.Query().Get("channel"), "#"))
+	channels.Lock()
+	list := []*channel{}
+	for _, ch := range channels.m {
+		if filter == "" || ch.Name == filter {
+			list = append(list, ch)
+		}
+	}
+	channels.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	data := []channelCommands{}
+	for _, ch := range list {
+		data = append(data, channelCommands{ch.Name, ch.cmds.List()})
+	}
+	commandListTemplate.Execute(w, data)
+}
+
 func githubWebhook(w http.ResponseWriter, r *http.Request) {
 	event := r.Header.Get("X-GitHub-Event")
 	signature := r.Header.Get("X-Hub-Signature")
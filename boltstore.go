@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBucket = []byte("data")
+
+// boltStore keeps a store in a bbolt database, so a change costs one small
+// transaction however big the store is. Everything is still held in memory
+// for reads, bbolt just makes writes cheap and durable.
+type boltStore struct {
+	*memStore
+	db *bolt.DB
+}
+
+// newBoltStore loads path, refusing to start if it exists but can't be read
+func newBoltStore(path string) *boltStore {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		log.Fatalf("Can't open %s: %v", path, err)
+	}
+	s := &boltStore{newMemStore(), db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(boltBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if !json.Valid(v) {
+				return fmt.Errorf("%q isn't valid JSON", k)
+			}
+			// Values are only valid for the life of the transaction
+			s.data[string(k)] = append(json.RawMessage(nil), v...)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Fatalf("%s is corrupt, refusing to start: %v", path, err)
+	}
+	s.save = s.write
+	return s
+}
+
+// write saves changes in one transaction, so they all land or none do
+func (s *boltStore) write(changes map[string]json.RawMessage) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		for k, v := range changes {
+			var err error
+			if v == nil {
+				err = b.Delete([]byte(k))
+			} else {
+				err = b.Put([]byte(k), v)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close releases the database's file lock
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+)
+
+type category struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// findCategory resolves a game name to a Twitch category, picking the closest
+// of Twitch's search results rather than trusting its ordering.
+func findCategory(name string) (*category, error) {
+	var data struct {
+		Data []category `json:"data"`
+	}
+	if err := helix.get(&data, "search/categories", url.Values{"query": {name}, "first": {"20"}}); err != nil {
+		return nil, err
+	}
+	if len(data.Data) == 0 {
+		return nil, fmt.Errorf("no game found matching %q", name)
+	}
+
+	want := normalizeName(name)
+	best, bestScore := 0, -1
+	for i, c := range data.Data {
+		got := normalizeName(c.Name)
+		score := 0
+		switch {
+		case got == want:
+			return &data.Data[i], nil
+		case strings.HasPrefix(got, want):
+			score = 3000 - len(got)
+		case strings.Contains(got, want):
+			score = 2000 - len(got)
+		default:
+			score = 1000 - levenshtein(want, got)
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return &data.Data[best], nil
+}
+
+func normalizeName(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+	}), " ")
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// modifyChannel calls Helix Modify Channel Information as the broadcaster
+func modifyChannel(ch *channel, changes map[string]string) error {
+	err := helix.do(ch.broadcasterToken, "PATCH", "channels", url.Values{"broadcaster_id": {ch.RoomID}}, changes, nil)
+	if err != nil {
+		return err
+	}
+	// Pick up the change now rather than on the next poll
+	go func() {
+		if err := pollChannels([]*channel{ch}); err != nil {
+			log.Printf("pollChannels=%v", err)
+		}
+	}()
+	return nil
+}
+
+func modifyChannelError(ch *channel, err error) string {
+	log.Printf("modifyChannel(%s)=%v", ch.Name, err)
+	if err == errNoUserToken {
+		return "I need permission first! The broadcaster can grant it at " + authURL()
+	}
+	return "Twitch didn't accept that, sorry"
+}
+
+// authURL is where broadcasters go to authorize the bot, derived from the
+// configured OAuth redirect
+func authURL() string {
+	return strings.TrimSuffix(REDIRECT_URL, "/callback") + "/twitch"
+}
+
+func cmdTitle(ch *channel, _ *User, title string) string {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		if t := ch.Stream().Title; t != "" {
+			return "Title: " + t
+		}
+		return "Usage: !title <new title>"
+	}
+	if err := modifyChannel(ch, map[string]string{"title": title}); err != nil {
+		return modifyChannelError(ch, err)
+	}
+	return "Title updated!"
+}
+
+func cmdSetGame(ch *channel, _ *User, name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "Usage: !setgame <game>"
+	}
+	c, err := findCategory(name)
+	if err != nil {
+		log.Printf("findCategory=%v", err)
+		return fmt.Sprintf("Couldn't find a game called %q", name)
+	}
+	if err := modifyChannel(ch, map[string]string{"game_id": c.ID}); err != nil {
+		return modifyChannelError(ch, err)
+	}
+	return "Game set to " + c.Name
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// channel holds everything that belongs to a single streamer's chat. State is
+// keyed by room ID rather than channel name since names can change.
+type channel struct {
+	lines int64 // accessed atomically, so kept first for alignment
+
+	Name     string
+	RoomID   string
+	quotes   Storage
+	counters Storage
+	ledger   *ledger
+	welcomes Storage
+	timers   Storage
+	auth     Storage
+	cmds     *commands
+
+	timerLock  sync.Mutex
+	timerLines map[string]int64 // value of lines when each timer last posted
+
+	authLock sync.Mutex
+
+	chatterLock sync.Mutex
+	chatters    map[string]bool // who has chatted since watch earnings were last paid
+
+	streamLock sync.RWMutex
+	stream     streamState
+}
+
+var channels = struct {
+	sync.Mutex
+	m map[string]*channel
+}{m: make(map[string]*channel)}
+
+// getChannel returns the state for a room, or nil if it hasn't been opened
+func getChannel(roomID string) *channel {
+	channels.Lock()
+	defer channels.Unlock()
+	return channels.m[roomID]
+}
+
+// openChannel returns the state for a room, loading it from disk the first
+// time the room is seen. A store that's corrupt still stops the bot, rather
+// than it carrying on with that channel's data missing.
+func openChannel(roomID, name string) (*channel, error) {
+	channels.Lock()
+	defer channels.Unlock()
+
+	name = strings.TrimPrefix(name, "#")
+	if ch, ok := channels.m[roomID]; ok {
+		return ch, nil
+	}
+	if err := prepareChannelDir(roomID, name); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Loading channel %s (%s)", name, roomID)
+	ch := &channel{
+		Name:     name,
+		RoomID:   roomID,
+		quotes:   upgradeQuotes(channelStore(roomID, "quotes")),
+		counters: channelStore(roomID, "counters"),
+		ledger:   newLedger(AppendOnlyStore(channelPath(roomID, "ledger")), channelStore(roomID, "balances")),
+		welcomes: channelStore(roomID, "welcomes"),
+		timers:   channelStore(roomID, "timers"),
+		auth:     channelStore(roomID, "auth"),
+
+		timerLines: make(map[string]int64),
+		chatters:   make(map[string]bool),
+	}
+	ch.cmds = newCommands(ch)
+	channels.m[roomID] = ch
+
+	// Fill in the stream state now rather than waiting for the next poll
+	go func() {
+		if err := pollChannels([]*channel{ch}); err != nil {
+			log.Printf("pollChannels=%v", err)
+		}
+	}()
+	return ch, nil
+}
+
+// channelStoreNames are the stores every channel has
+var channelStoreNames = []string{"quotes", "counters", "ledger", "balances", "welcomes", "timers", "auth", "commands", "aliases", "levels", "cooldowns"}
+
+// channelStore opens a store under channels/<room id>/
+func channelStore(roomID, name string) Storage {
+	return Store(channelPath(roomID, name))
+}
+
+// channelPath returns where a channel's store lives, without an extension
+func channelPath(roomID, name string) string {
+	return filepath.Join("channels", roomID, name)
+}
+
+// prepareChannelDir creates channels/<room id>/. Before multi-channel support
+// every store lived in the working directory, so those files are adopted by
+// the first configured channel.
+func prepareChannelDir(roomID, channelName string) error {
+	if err := os.MkdirAll(filepath.Join("channels", roomID), 0755); err != nil {
+		return err
+	}
+	if len(CHANNELS) == 0 || !strings.EqualFold(CHANNELS[0], channelName) {
+		return nil
+	}
+	for _, name := range channelStoreNames {
+		path := channelPath(roomID, name)
+		for _, ext := range storeExts {
+			if _, err := os.Stat(path + ext); !os.IsNotExist(err) {
+				continue
+			}
+			if _, err := os.Stat(name + ext); err == nil {
+				log.Printf("Moving %s%s to %s%s", name, ext, path, ext)
+				if err := os.Rename(name+ext, path+ext); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	IRCIdleConnectionTimeout = 5 * time.Minute
+
+	// Twitch allows 8 KB of tags, plus up to 500 characters of message at
+	// 4 bytes each and the prefix, command and channel
+	maxLineLength = 16 * 1024
+
+	ircDefaultHost          = "irc.chat.twitch.tv"
+	ircDefaultTLSPort       = "6697"
+	ircDefaultPlaintextPort = "6667"
+
+	ircMinBackoff = time.Second
+	ircMaxBackoff = 2 * time.Minute
+	// A connection that stays up this long resets the backoff
+	ircStableConnection = time.Minute
+)
+
+var errReconnect = errors.New("server requested a reconnect")
+
+// ircClient owns the connection to Twitch chat. The outbound queue lives on
+// the client rather than the connection so nothing queued is lost when we
+// have to redial.
+type ircClient struct {
+	out *outbox
+}
+
+func (c *ircClient) run() {
+	backoff := ircMinBackoff
+	for {
+		start := time.Now()
+		err := c.session()
+		log.Printf("IRC connection lost: %v", err)
+
+		if time.Since(start) > ircStableConnection {
+			backoff = ircMinBackoff
+		}
+		// Full jitter on the upper half so a Twitch-wide disconnect doesn't have every bot redial in lockstep
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		log.Printf("Reconnecting in %v", wait)
+		time.Sleep(wait)
+
+		if backoff *= 2; backoff > ircMaxBackoff {
+			backoff = ircMaxBackoff
+		}
+	}
+}
+
+// dialIRC connects to chat over TLS unless BOT_IRC_PLAINTEXT=1. BOT_IRC_CA_FILE
+// replaces the system roots, which lets a local stand-in use a self-signed CA.
+func dialIRC() (net.Conn, error) {
+	host, port := IRC_HOST, IRC_PORT
+	if host == "" {
+		host = ircDefaultHost
+	}
+	if port == "" {
+		port = ircDefaultTLSPort
+		if IRC_PLAINTEXT {
+			port = ircDefaultPlaintextPort
+		}
+	}
+	addr := net.JoinHostPort(host, port)
+
+	if IRC_PLAINTEXT {
+		return net.Dial("tcp", addr)
+	}
+
+	config := &tls.Config{ServerName: host}
+	if IRC_CA_FILE != "" {
+		pem, err := os.ReadFile(IRC_CA_FILE)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", IRC_CA_FILE)
+		}
+	}
+	return tls.Dial("tcp", addr, config)
+}
+
+func (c *ircClient) session() error {
+	conn, err := dialIRC()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	handshake := "CAP REQ :twitch.tv/tags twitch.tv/commands\r\n" +
+		fmt.Sprintf("PASS oauth:%s\r\n", PASSWORD) +
+		fmt.Sprintf("USER %s\r\n", USER) +
+		fmt.Sprintf("NICK %s\r\n", USER)
+	if _, err := fmt.Fprint(conn, handshake); err != nil {
+		return err
+	}
+	log.Print("Connected to IRC")
+
+	// JOINs go through the outbox so joining many channels respects the join
+	// limit, but ahead of any chat that built up while we were disconnected
+	c.out.Join(CHANNELS)
+
+	done := make(chan struct{})
+	defer close(done)
+	go c.write(conn, done)
+
+	in := bufio.NewReaderSize(conn, maxLineLength)
+	for {
+		conn.SetReadDeadline(time.Now().Add(IRCIdleConnectionTimeout))
+		line, err := in.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Skip the rest of an oversized line rather than dropping every channel
+			for err == bufio.ErrBufferFull {
+				_, err = in.ReadSlice('\n')
+			}
+			if err != nil {
+				return err
+			}
+			log.Printf("Ignoring line longer than %d bytes", maxLineLength)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		//log.Printf("[IN]  %s", line)
+		m, err := parse(line)
+		if err != nil {
+			log.Printf("Ignoring unparsable line %q: %v", line, err)
+			continue
+		}
+		if m.Command == "RECONNECT" {
+			return errReconnect
+		}
+		go handle(c.out, m)
+	}
+}
+
+func (c *ircClient) write(conn net.Conn, done chan struct{}) {
+	for {
+		m, ok := c.out.next(done)
+		if !ok {
+			return
+		}
+		//log.Printf("[OUT] %s", m)
+		if _, err := fmt.Fprint(conn, m); err != nil {
+			log.Printf("IRC write failed: %v", err)
+			c.out.requeue(m)
+			conn.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Per user cooldowns that have run out are cleared this often
+const cooldownSweepInterval = time.Minute
+
+// cooldown limits how often a command can be used, both by anyone (global)
+// and by any one viewer (user). Mods are exempt unless mods is set.
+type cooldown struct {
+	global time.Duration
+	user   time.Duration
+	mods   bool
+}
+
+// parseCooldown reads "<global> [user] [mods]", e.g. "30s 2m mods"
+func parseCooldown(v string) (cooldown, error) {
+	var cd cooldown
+	durations := 0
+	for _, f := range strings.Fields(strings.ToLower(v)) {
+		switch f {
+		case "mods":
+			cd.mods = true
+			continue
+		case "off":
+			f = "0s"
+		}
+		d, err := time.ParseDuration(f)
+		if f == "0" {
+			d, err = 0, nil
+		}
+		if err != nil || d < 0 {
+			return cd, fmt.Errorf("%q isn't a duration like 30s or 2m", f)
+		}
+		switch durations {
+		case 0:
+			cd.global = d
+		case 1:
+			cd.user = d
+		default:
+			return cd, fmt.Errorf("too many durations")
+		}
+		durations++
+	}
+	return cd, nil
+}
+
+func (cd cooldown) String() string {
+	s := fmt.Sprintf("%s %s", cd.global, cd.user)
+	if cd.mods {
+		s += " mods"
+	}
+	return s
+}
+
+func (cd cooldown) isZero() bool {
+	return cd.global == 0 && cd.user == 0
+}
+
+// Cooldown records a use of the named command and reports whether it was
+// allowed.
+func (c *commands) Cooldown(name, userID string, isMod bool) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	cd, ok := c.cooldowns[name]
+	if !ok || (isMod && !cd.mods) {
+		return true
+	}
+
+	now := time.Now()
+	if now.Sub(c.lastSweep) >= cooldownSweepInterval {
+		c.sweepCooldowns(now)
+	}
+	userKey := name + " " + userID
+	if now.Before(c.lastUsed[name].Add(cd.global)) || now.Before(c.lastUsedBy[userKey].Add(cd.user)) {
+		return false
+	}
+
+	c.lastUsed[name] = now
+	c.lastUsedBy[userKey] = now
+	return true
+}
+
+// sweepCooldowns forgets per user uses whose cooldown has run out, so
+// lastUsedBy doesn't grow with every viewer who's ever used a command. The
+// caller must hold c's lock.
+func (c *commands) sweepCooldowns(now time.Time) {
+	for key, t := range c.lastUsedBy {
+		name, _, _ := strings.Cut(key, " ")
+		if cd, ok := c.cooldowns[name]; !ok || now.Sub(t) >= cd.user {
+			delete(c.lastUsedBy, key)
+		}
+	}
+	c.lastSweep = now
+}
+
+func cmdCooldown(ch *channel, _ *User, data string) string {
+	v := split(data, 2)
+	name := strings.TrimPrefix(v[0], "!")
+	if name == "" {
+		return "Usage: !cooldown <command> <global> [per user] [mods], e.g. !cooldown roll 30s 2m"
+	}
+
+	ch.cmds.Lock()
+	defer ch.cmds.Unlock()
+
+	if actual, ok := ch.cmds.aliases[name]; ok {
+		name = actual
+	}
+	if _, ok := ch.cmds.cmds[name]; !ok {
+		return fmt.Sprintf("!%s isn't a command", name)
+	}
+
+	if strings.TrimSpace(v[1]) == "" {
+		if cd, ok := ch.cmds.cooldowns[name]; ok {
+			return fmt.Sprintf("!%s cooldown: %s", name, cd)
+		}
+		return fmt.Sprintf("!%s has no cooldown", name)
+	}
+
+	cd, err := parseCooldown(v[1])
+	if err != nil {
+		return fmt.Sprintf("Invalid cooldown: %s", err)
+	}
+	if cd.isZero() {
+		if err := ch.cmds.cooldownStore.Remove(name); err != nil {
+			return errSaving(err)
+		}
+		delete(ch.cmds.cooldowns, name)
+		return fmt.Sprintf("Removed the !%s cooldown", name)
+	}
+	if err := ch.cmds.cooldownStore.Add(name, cd.String()); err != nil {
+		return errSaving(err)
+	}
+	ch.cmds.cooldowns[name] = cd
+	return fmt.Sprintf("!%s cooldown set to %s", name, cd)
+}
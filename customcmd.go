@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// customCommand is what's saved in commands.json for each custom command
+type customCommand struct {
+	Response    string    `json:"response"`
+	CreatorID   string    `json:"creator_id,omitempty"`
+	CreatorName string    `json:"creator_name,omitempty"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+	Uses        int       `json:"uses"`
+}
+
+// Use counts are kept in memory and saved this often
+const usesFlushInterval = time.Minute
+
+// loadCustomCommand reads a command record, upgrading the bare response
+// strings that were stored before commands had metadata. load is a store's
+// or a Tx's Load.
+func loadCustomCommand(load func(string, interface{}) bool, name string) (customCommand, bool) {
+	var cc customCommand
+	if load(name, &cc) {
+		return cc, true
+	}
+	var response string
+	if load(name, &response) {
+		return customCommand{Response: response}, true
+	}
+	return cc, false
+}
+
+// cmdCustom returns the handler for a custom command. The response is read
+// from the store on every use so edits take effect immediately, and anything
+// saved before templates existed that no longer parses is returned as-is.
+func cmdCustom(name string) func(*channel, *User, string) string {
+	return func(ch *channel, u *User, args string) string {
+		ch.cmds.RLock()
+		cc, ok := loadCustomCommand(ch.cmds.store.Load, name)
+		ch.cmds.RUnlock()
+		if !ok {
+			return ""
+		}
+		ch.cmds.countUse(name)
+
+		parts, err := parseTemplate(cc.Response)
+		if err != nil {
+			return cc.Response
+		}
+		return executeTemplate(parts, &templateContext{ch, u, args, nil})
+	}
+}
+
+// countUse notes a use of a custom command. Uses are saved by flushUses, so
+// running a command doesn't cost a write.
+func (c *commands) countUse(name string) {
+	c.usesLock.Lock()
+	defer c.usesLock.Unlock()
+	c.uses[name]++
+}
+
+// pendingUses is how many uses of a command haven't been saved yet
+func (c *commands) pendingUses(name string) int {
+	c.usesLock.Lock()
+	defer c.usesLock.Unlock()
+	return c.uses[name]
+}
+
+// dropUses forgets the unsaved uses of a command
+func (c *commands) dropUses(name string) {
+	c.usesLock.Lock()
+	defer c.usesLock.Unlock()
+	delete(c.uses, name)
+}
+
+// flushUses adds the uses counted since the last flush to the saved records,
+// all in one write. It doesn't need the command lock.
+func (c *commands) flushUses() error {
+	c.usesLock.Lock()
+	uses := c.uses
+	c.uses = make(map[string]int)
+	c.usesLock.Unlock()
+	if len(uses) == 0 {
+		return nil
+	}
+
+	tx := c.store.Begin()
+	defer tx.Rollback()
+	for name, n := range uses {
+		cc, ok := loadCustomCommand(tx.Load, name)
+		if !ok {
+			continue // removed since
+		}
+		cc.Uses += n
+		if err := tx.Put(name, cc); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		// Keep the counts for the next try
+		c.usesLock.Lock()
+		for name, n := range uses {
+			c.uses[name] += n
+		}
+		c.usesLock.Unlock()
+		return err
+	}
+	return nil
+}
+
+func runFlushUses() {
+	for range time.Tick(usesFlushInterval) {
+		channels.Lock()
+		list := make([]*channel, 0, len(channels.m))
+		for _, ch := range channels.m {
+			list = append(list, ch)
+		}
+		channels.Unlock()
+
+		for _, ch := range list {
+			if err := ch.cmds.flushUses(); err != nil {
+				log.Printf("flushUses(%s)=%v", ch.Name, err)
+			}
+		}
+	}
+}
+
+// customCommandName resolves a trigger to a custom command, or explains why it can't
+func customCommandName(ch *channel, trigger string) (string, string) {
+	name := ch.cmds.resolve(strings.TrimPrefix(trigger, "!"))
+	cmd, ok := ch.cmds.cmds[name]
+	if !ok {
+		return "", fmt.Sprintf("!%s isn't a command", name)
+	}
+	if !cmd.removable {
+		return "", "I'm afraid that command isn't editable"
+	}
+	return name, ""
+}
+
+func cmdEditCommand(ch *channel, _ *User, data string) string {
+	ch.cmds.Lock()
+	defer ch.cmds.Unlock()
+	v := split(data, 2)
+	name, errMsg := customCommandName(ch, v[0])
+	if errMsg != "" {
+		return errMsg
+	}
+	if strings.TrimSpace(v[1]) == "" {
+		return "Usage: !editcommand <command> <new response>"
+	}
+	if _, err := parseTemplate(v[1]); err != nil {
+		return fmt.Sprintf("Can't edit !%s: %s", name, err)
+	}
+
+	// In a Tx so a flush of use counts can't land in between
+	tx := ch.cmds.store.Begin()
+	defer tx.Rollback()
+	cc, _ := loadCustomCommand(tx.Load, name)
+	cc.Response, cc.Updated = v[1], time.Now()
+	if err := tx.Put(name, cc); err != nil {
+		return errSaving(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return errSaving(err)
+	}
+	return fmt.Sprintf("Updated !%s", name)
+}
+
+func cmdShowCommand(ch *channel, _ *User, data string) string {
+	ch.cmds.RLock()
+	defer ch.cmds.RUnlock()
+	name, errMsg := customCommandName(ch, split(data, 2)[0])
+	if errMsg != "" {
+		return errMsg
+	}
+
+	cc, _ := loadCustomCommand(ch.cmds.store.Load, name)
+	cc.Uses += ch.cmds.pendingUses(name)
+	info := []string{}
+	if cc.CreatorName != "" {
+		info = append(info, "added by "+cc.CreatorName)
+	}
+	if !cc.Created.IsZero() {
+		info = append(info, "on "+cc.Created.Format("2006-01-02"))
+	}
+	if !cc.Updated.IsZero() && cc.Updated.Sub(cc.Created) > time.Second {
+		info = append(info, "edited "+cc.Updated.Format("2006-01-02"))
+	}
+	info = append(info, fmt.Sprintf("used %d times", cc.Uses))
+	return fmt.Sprintf("!%s: %s (%s)", name, cc.Response, strings.Join(info, ", "))
+}
+
+func cmdRenameCommand(ch *channel, _ *User, data string) string {
+	ch.cmds.Lock()
+	defer ch.cmds.Unlock()
+	v := split(data, 3)
+	name, errMsg := customCommandName(ch, v[0])
+	if errMsg != "" {
+		return errMsg
+	}
+	newName := strings.ToLower(strings.TrimPrefix(v[1], "!"))
+	if newName == "" {
+		return "Usage: !renamecommand <command> <new name>"
+	}
+	if _, ok := ch.cmds.cmds[newName]; ok {
+		return fmt.Sprintf("!%s already exists", newName)
+	}
+	if _, ok := ch.cmds.aliases[newName]; ok {
+		return fmt.Sprintf("!%s is already an alias", newName)
+	}
+
+	// Counts still waiting under the old name would be lost
+	if err := ch.cmds.flushUses(); err != nil {
+		return errSaving(err)
+	}
+
+	// Save under the new name before dropping the old one, so a failure
+	// part way through leaves a duplicate rather than losing the command
+	var raw json.RawMessage
+	ch.cmds.store.Load(name, &raw)
+	if err := ch.cmds.store.Put(newName, raw); err != nil {
+		return errSaving(err)
+	}
+	ch.cmds.cmds[newName] = newCustomCommand(newName)
+	if err := ch.cmds.store.Remove(name); err != nil {
+		return errSaving(err)
+	}
+	delete(ch.cmds.cmds, name)
+
+	// Settings follow the command
+	if l, ok := ch.cmds.levels[name]; ok {
+		if err := ch.cmds.levelStore.Add(newName, l.String()); err != nil {
+			return errSaving(err)
+		}
+		ch.cmds.levels[newName] = l
+		delete(ch.cmds.levels, name)
+		ch.cmds.levelStore.Remove(name)
+	}
+	if cd, ok := ch.cmds.cooldowns[name]; ok {
+		if err := ch.cmds.cooldownStore.Add(newName, cd.String()); err != nil {
+			return errSaving(err)
+		}
+		ch.cmds.cooldowns[newName] = cd
+		delete(ch.cmds.cooldowns, name)
+		ch.cmds.cooldownStore.Remove(name)
+	}
+	for alias, actual := range ch.cmds.aliases {
+		if actual == name {
+			ch.cmds.aliases[alias] = newName
+			if _, ok := ch.cmds.aliasStore.Get(alias); ok {
+				if err := ch.cmds.aliasStore.Add(alias, newName); err != nil {
+					return errSaving(err)
+				}
+			}
+		}
+	}
+	if aliases, ok := ch.cmds.rAliases[name]; ok {
+		ch.cmds.rAliases[newName] = aliases
+		delete(ch.cmds.rAliases, name)
+	}
+
+	return fmt.Sprintf("Renamed !%s to !%s", name, newName)
+}
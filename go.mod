@@ -0,0 +1,7 @@
+module github.com/Fugiman/kaet
+
+go 1.23
+
+require go.etcd.io/bbolt v1.4.3
+
+require golang.org/x/sys v0.29.0 // indirect
@@ -2,43 +2,59 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"math"
 	"math/rand"
-	"os"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
-var (
-	cmdPrefixes []string
-	quotes      *store
-	counters    *store
-	balances    *store
-	cmds        *commands
-)
+var cmdPrefixes []string
 
 type commands struct {
 	sync.RWMutex
-	cmds        map[string]*command
-	aliases     map[string]string
-	rAliases    map[string][]string
-	store       *store
-	currentBet  map[string]map[string]int
-	bettingOpen bool
+	cmds          map[string]*command
+	aliases       map[string]string
+	rAliases      map[string][]string
+	store         Storage
+	aliasStore    Storage
+	levels        map[string]level
+	levelStore    Storage
+	cooldowns     map[string]cooldown
+	cooldownStore Storage
+	lastUsed      map[string]time.Time
+	lastUsedBy    map[string]time.Time
+	lastSweep     time.Time
+	usesLock      sync.Mutex
+	uses          map[string]int // custom command uses not saved yet
+	currentBet    map[string]map[string]int
+	betID         string // correlation ID for the current bet's ledger entries
+	bettingOpen   bool
 }
 
 type command struct {
-	fn        func(*User, string) string
-	modOnly   bool
-	removable bool
+	fn          func(*channel, *User, string) string
+	level       level
+	removable   bool
+	description string
+	usage       string
+}
+
+func newCounterCommand(name string) *command {
+	return &command{cmdCounter(name), levelEveryone, false, "Shows the " + name + " counter", "!" + name}
+}
+
+func newCustomCommand(name string) *command {
+	return &command{cmdCustom(name), levelEveryone, true, "Custom command", "!" + name}
 }
 
 type User struct {
-	ID   string
-	Name string
+	ID    string
+	Name  string
+	Login string
+	Level level
 }
 
 func (c *commands) Alias(alias, actual string) {
@@ -47,65 +63,118 @@ func (c *commands) Alias(alias, actual string) {
 	if _, ok := c.cmds[actual]; !ok {
 		panic(fmt.Errorf("Invalid alias: %s -> %s", alias, actual))
 	}
-	c.aliases[alias] = actual
-	c.rAliases[actual] = append(c.rAliases[actual], alias)
+	c.alias(alias, actual)
 }
 
 func (c *commands) Get(key string) *command {
 	c.RLock()
 	defer c.RUnlock()
+	return c.cmds[c.resolve(key)]
+}
+
+// Resolve returns the name of the command an alias points to
+func (c *commands) Resolve(key string) string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.resolve(key)
+}
+
+func (c *commands) resolve(key string) string {
 	if nKey, ok := c.aliases[key]; ok {
-		key = nKey
+		return nKey
 	}
-	return c.cmds[key]
+	return key
 }
 
+// replyCommands answer whoever ran them, so their responses are threaded as
+// replies. Everything else, like betting announcements, is said to the channel.
+var replyCommands = map[string]bool{"bet": true, "give": true, CURRENCY_NAME: true, "roll": true, "followage": true, "accountage": true, "help": true}
+
 func init() {
 	cmdPrefixes = []string{"!", USER + " ", fmt.Sprintf("@%s ", USER)}
+}
 
-	quotes = Store("quotes")
-	counters = Store("counters")
-	balances = Store("balances")
-
-	cmds = &commands{
-		cmds:     map[string]*command{},
-		aliases:  map[string]string{},
-		rAliases: map[string][]string{},
-		store:    Store("commands"),
+func newCommands(ch *channel) *commands {
+	cmds := &commands{
+		cmds:          map[string]*command{},
+		aliases:       map[string]string{},
+		rAliases:      map[string][]string{},
+		store:         channelStore(ch.RoomID, "commands"),
+		aliasStore:    channelStore(ch.RoomID, "aliases"),
+		levels:        map[string]level{},
+		levelStore:    channelStore(ch.RoomID, "levels"),
+		cooldowns:     map[string]cooldown{},
+		cooldownStore: channelStore(ch.RoomID, "cooldowns"),
+		lastUsed:      map[string]time.Time{},
+		lastUsedBy:    map[string]time.Time{},
+		uses:          map[string]int{},
+	}
+
+	for _, k := range cmds.levelStore.Keys() {
+		v, _ := cmds.levelStore.Get(k)
+		if l, ok := parseLevel(v); ok {
+			cmds.levels[k] = l
+		}
+	}
+	for _, k := range cmds.cooldownStore.Keys() {
+		v, _ := cmds.cooldownStore.Get(k)
+		// Cooldowns used to be able to whisper, which Twitch no longer allows
+		v = strings.Replace(v, " whisper", "", 1)
+		if cd, err := parseCooldown(v); err == nil {
+			cmds.cooldowns[k] = cd
+		}
 	}
 
 	// Dynamic commands
-	for _, k := range counters.Keys() {
-		cmds.cmds[k] = &command{cmdCounter(k), false, false}
+	for _, k := range ch.counters.Keys() {
+		cmds.cmds[k] = newCounterCommand(k)
 	}
 	for _, k := range cmds.store.Keys() {
-		v, _ := cmds.store.Get(k)
-		cmds.cmds[k] = &command{func(_ *User, _ string) string { return v }, false, true}
+		cmds.cmds[k] = newCustomCommand(k)
 	}
 
 	// Pleb commands
-	cmds.cmds["uptime"] = &command{func(_ *User, _ string) string { return getUptime(CHANNEL) }, false, false}
-	cmds.cmds["game"] = &command{func(_ *User, _ string) string { return getGame(CHANNEL, true) }, false, false}
-	cmds.cmds["quote"] = &command{cmdGetQuote, false, false}
-	cmds.cmds["sourcecode"] = &command{func(_ *User, q string) string {
+	cmds.cmds["uptime"] = &command{func(ch *channel, _ *User, _ string) string { return getUptime(ch) }, levelEveryone, false, "How long the stream has been live", "!uptime"}
+	cmds.cmds["game"] = &command{func(ch *channel, _ *User, _ string) string { return getGame(ch, true) }, levelEveryone, false, "The current game and its rating", "!game"}
+	cmds.cmds["quote"] = &command{cmdGetQuote, levelEveryone, false, "A random quote, or one matching a number, game, person or search", "!quote [#number|game:<name>|by:<person>|search]"}
+	cmds.cmds["lastquote"] = &command{cmdLastQuote, levelEveryone, false, "The newest quote", "!lastquote"}
+	cmds.cmds["quotecount"] = &command{cmdQuoteCount, levelEveryone, false, "How many quotes there are, or how many match", "!quotecount [game:<name>|by:<person>|search]"}
+	cmds.cmds["sourcecode"] = &command{func(_ *channel, _ *User, q string) string {
 		return "Contribute to kaet's source code at github.com/Fugiman/kaet VoHiYo"
-	}, false, false}
-	cmds.cmds["bet"] = &command{cmdBet, false, false}
-	cmds.cmds[CURRENCY_NAME] = &command{cmdBalance, false, false}
-	cmds.cmds["roll"] = &command{cmdRoll, false, false}
+	}, levelEveryone, false, "Where to find the bot's source code", "!sourcecode"}
+	cmds.cmds["bet"] = &command{cmdBet, levelEveryone, false, "Bet " + CURRENCY_NAME + " on the open bet", "!bet <choice> <amount>"}
+	cmds.cmds["give"] = &command{cmdGive, levelEveryone, false, "Give some of your " + CURRENCY_NAME + " to someone", "!give <user> <amount>"}
+	cmds.cmds[CURRENCY_NAME] = &command{cmdBalance, levelEveryone, false, "How much " + CURRENCY_NAME + " you have", "!" + CURRENCY_NAME}
+	cmds.cmds["help"] = &command{cmdHelp, levelEveryone, false, "List commands, or explain one", "!help [command]"}
+	cmds.cmds["followage"] = &command{cmdFollowAge, levelEveryone, false, "How long you, or someone else, have followed", "!followage [user]"}
+	cmds.cmds["accountage"] = &command{cmdAccountAge, levelEveryone, false, "How old your, or someone else's, Twitch account is", "!accountage [user]"}
+	cmds.cmds["roll"] = &command{cmdRoll, levelEveryone, false, "Roll some dice", "!roll <dice>, e.g. !roll 2d6 d20"}
 
 	// Mod commands
-	cmds.cmds["help"] = &command{cmdHelp, true, false}
-	cmds.cmds["addquote"] = &command{cmdAddQuote, true, false}
-	cmds.cmds["removequote"] = &command{cmdRemoveQuote, true, false}
-	cmds.cmds["addcommand"] = &command{cmdAddCommand, true, false}
-	cmds.cmds["removecommand"] = &command{cmdRemoveCommand, true, false}
-	cmds.cmds["increment"] = &command{cmdIncrement, true, false}
-	cmds.cmds["decrement"] = &command{cmdDecrement, true, false}
-	cmds.cmds["reset"] = &command{cmdReset, true, false}
-	cmds.cmds["open"] = &command{cmdOpen, true, false}
-	cmds.cmds["close"] = &command{cmdClose, true, false}
-	cmds.cmds["payout"] = &command{cmdPayout, true, false}
+	cmds.cmds["addquote"] = &command{cmdAddQuote, levelModerator, false, "Save a quote with the current game and date", "!addquote [by:<person>] <quote>"}
+	cmds.cmds["editquote"] = &command{cmdEditQuote, levelModerator, false, "Change a quote's text, game or person", "!editquote <#number> <text|game:<name>|by:<person>>"}
+	cmds.cmds["removequote"] = &command{cmdRemoveQuote, levelModerator, false, "Delete a quote", "!removequote <#number>"}
+	cmds.cmds["addcommand"] = &command{cmdAddCommand, levelModerator, false, "Add a custom command. Responses can use $(user), $(touser), $(args N), $(uptime), $(game), $(count name), $(random min max), $(quote) and $(balance)", "!addcommand <command> <response>"}
+	cmds.cmds["removecommand"] = &command{cmdRemoveCommand, levelModerator, false, "Delete a custom command", "!removecommand <command>"}
+	cmds.cmds["editcommand"] = &command{cmdEditCommand, levelModerator, false, "Change a custom command's response", "!editcommand <command> <response>"}
+	cmds.cmds["showcommand"] = &command{cmdShowCommand, levelModerator, false, "Show a custom command's response and history", "!showcommand <command>"}
+	cmds.cmds["renamecommand"] = &command{cmdRenameCommand, levelModerator, false, "Rename a custom command", "!renamecommand <command> <new name>"}
+	cmds.cmds["increment"] = &command{cmdIncrement, levelModerator, false, "Add one to a counter, creating it if needed", "!increment <counter>"}
+	cmds.cmds["decrement"] = &command{cmdDecrement, levelModerator, false, "Subtract one from a counter", "!decrement <counter>"}
+	cmds.cmds["reset"] = &command{cmdReset, levelModerator, false, "Delete a counter", "!reset <counter>"}
+	cmds.cmds["open"] = &command{cmdOpen, levelModerator, false, "Open betting", "!open <question>? <choice> <choice>..."}
+	cmds.cmds["close"] = &command{cmdClose, levelModerator, false, "Close betting", "!close"}
+	cmds.cmds["payout"] = &command{cmdPayout, levelModerator, false, "Pay out the bet to everyone who picked the winner", "!payout <winning choice>"}
+	cmds.cmds["cancel"] = &command{cmdCancel, levelModerator, false, "Call off the bet and refund everyone", "!cancel"}
+	cmds.cmds["ledger"] = &command{cmdLedger, levelModerator, false, "Someone's recent " + CURRENCY_NAME + " history", "!ledger <user>"}
+	cmds.cmds["adjust"] = &command{cmdAdjust, levelModerator, false, "Add to or take from someone's " + CURRENCY_NAME, "!adjust <user> <+/-amount> [reason]"}
+	cmds.cmds["welcome"] = &command{cmdWelcome, levelModerator, false, "Show or change the message for subs, resubs, gift subs, raids and bits badges", "!welcome <event> [message|off|default]"}
+	cmds.cmds["cooldown"] = &command{cmdCooldown, levelModerator, false, "Show or set how often a command can be used", "!cooldown <command> <global> [per user] [mods]"}
+	cmds.cmds["permit-level"] = &command{cmdPermitLevel, levelModerator, false, "Show or set who can use a command", "!permit-level <command> [level|default]"}
+	cmds.cmds["alias"] = &command{cmdAlias, levelModerator, false, "Manage command aliases", "!alias add <alias> <command>, !alias remove <alias>, !alias list"}
+	cmds.cmds["title"] = &command{cmdTitle, levelModerator, false, "Show or change the stream title", "!title [new title]"}
+	cmds.cmds["setgame"] = &command{cmdSetGame, levelModerator, false, "Change the stream's game", "!setgame <game>"}
+	cmds.cmds["timer"] = &command{cmdTimer, levelModerator, false, "Manage messages posted regularly while live", "!timer add <name> <interval> <min lines> <message>, !timer remove|pause|resume <name>, !timer list"}
 
 	// Aliases
 	cmds.Alias("halp", "help")
@@ -120,24 +189,64 @@ func init() {
 	cmds.Alias("code", "sourcecode")
 	cmds.Alias("inc", "increment")
 	cmds.Alias("dec", "decrement")
+
+	// Aliases added from chat
+	for _, k := range cmds.aliasStore.Keys() {
+		v, _ := cmds.aliasStore.Get(k)
+		_, isCmd := cmds.cmds[k]
+		_, isAlias := cmds.aliases[k]
+		if _, ok := cmds.cmds[v]; ok && !isCmd && !isAlias {
+			cmds.alias(k, v)
+		}
+	}
+
+	return cmds
 }
 
-func handle(out chan string, m *message) {
+func handle(out *outbox, m *message) {
 	switch m.Command {
 	case "PING":
-		out <- fmt.Sprintf("PONG :%s\r\n", strings.Join(m.Args, " "))
-	case "RECONNECT":
-		os.Exit(69)
+		pong := &message{Command: "PONG", Args: []string{strings.Join(m.Args, " ")}}
+		out.Send(pong.encode())
+	case "USERSTATE":
+		// Sent on join and after each of our messages, tells us whether we're a mod here
+		if len(m.Args) > 0 {
+			out.SetMod(m.Args[0], m.Mod || m.IsBroadcaster())
+		}
+	case "ROOMSTATE":
+		// Sent on join, before anything else from the room
+		if m.RoomID != "" && len(m.Args) > 0 {
+			if _, err := openChannel(m.RoomID, m.Args[0]); err != nil {
+				log.Printf("openChannel(%s)=%v", m.Args[0], err)
+			}
+		}
+	case "USERNOTICE":
+		if ch := getChannel(m.RoomID); ch != nil && len(m.Args) > 0 {
+			handleUserNotice(out, ch, m)
+		}
 	case "PRIVMSG":
+		ch := getChannel(m.RoomID)
+		if ch == nil || len(m.Args) < 2 {
+			return
+		}
+		ch.countLine()
+		ch.seen(m.UserID)
 		msg := strings.ToLower(m.Args[1])
 		for _, prefix := range cmdPrefixes {
 			if strings.HasPrefix(msg, prefix) {
 				p := split(m.Args[1][len(prefix):], 2)
-				isMod := m.Mod || m.UserID != "" && m.RoomID == m.UserID
-				if c := cmds.Get(p[0]); c != nil && (!c.modOnly || isMod) {
-					u := &User{m.UserID, m.DisplayName}
-					if response := c.fn(u, p[1]); response != "" {
-						out <- fmt.Sprintf("PRIVMSG %s :\u200B%s\r\n", m.Args[0], response)
+				u := &User{m.UserID, m.DisplayName, m.Prefix.Nick, userLevel(m)}
+				name := ch.cmds.Resolve(p[0])
+				if c := ch.cmds.Get(name); c != nil && allowed(ch, u, ch.cmds.Level(name)) {
+					if !ch.cmds.Cooldown(name, u.ID, u.Level >= levelModerator) {
+						return
+					}
+					switch response := c.fn(ch, u, p[1]); {
+					case response == "":
+					case replyCommands[name]:
+						out.Reply(m, response)
+					default:
+						out.Say(m.Args[0], response)
 					}
 				}
 				return
@@ -146,132 +255,171 @@ func handle(out chan string, m *message) {
 	}
 }
 
-func cmdHelp(_ *User, _ string) string {
-	cmds.RLock()
-	defer cmds.RUnlock()
-	names := []string{}
-	for k := range cmds.cmds {
-		names = append(names, k)
-	}
-	sort.Strings(names)
-	return "Available Commands: " + strings.Join(names, " ")
-}
-
-func cmdAddQuote(_ *User, quote string) string {
-	g := getGame(CHANNEL, false)
-	t := time.Now().Round(time.Second)
-	if l, err := time.LoadLocation("America/Vancouver"); err == nil {
-		t = t.In(l)
-	}
-	quotes.Append(fmt.Sprintf("%s [Playing %s - %s]", quote, g, t.Format(time.RFC822)))
-	return ""
+// errSaving logs a failed store write and gives chat something to go on
+func errSaving(err error) string {
+	log.Printf("Failed to save: %v", err)
+	return "Sorry, I couldn't save that. Please try again"
 }
 
-func cmdRemoveQuote(_ *User, quoteNum string) string {
-	if strings.HasPrefix(quoteNum, "#") {
-		quoteNum = quoteNum[1:]
-	}
-	// cmdAddQuote relies on continuous numbering, so blank the quotes instead of removing them
-	if quotes.Blank(quoteNum) {
-		return fmt.Sprintf("Removed #%s", quoteNum)
+func cmdHelp(ch *channel, u *User, data string) string {
+	if name := strings.TrimPrefix(split(data, 2)[0], "!"); name != "" {
+		info, ok := ch.cmds.Info(name)
+		if !ok || !allowed(ch, u, info.Level) {
+			return fmt.Sprintf("!%s isn't a command", name)
+		}
+		help := fmt.Sprintf("%s - %s (%s", info.Usage, info.Description, info.Level)
+		if len(info.Aliases) > 0 {
+			help += "; aliases: !" + strings.Join(info.Aliases, " !")
+		}
+		return help + ")"
 	}
-	return ""
-}
 
-func cmdGetQuote(_ *User, query string) string {
-	if strings.HasPrefix(query, "#") {
-		if quote, found := quotes.Get(query[1:]); found && quote != "" {
-			return quote
+	names := []string{}
+	for _, info := range ch.cmds.List() {
+		// Counters would drown out everything else
+		if _, isCounter := ch.counters.Get(info.Name); !isCounter && allowed(ch, u, info.Level) {
+			names = append(names, info.Name)
 		}
-		return "Not found"
 	}
-	return quotes.Random(query)
+	return "Available Commands: " + strings.Join(names, " ") + " - use !help <command> for details"
 }
 
-func cmdAddCommand(_ *User, data string) string {
-	cmds.Lock()
-	defer cmds.Unlock()
+func cmdAddCommand(ch *channel, u *User, data string) string {
+	ch.cmds.Lock()
+	defer ch.cmds.Unlock()
 	v := split(data, 2)
 	trigger, msg := strings.TrimPrefix(v[0], "!"), v[1]
-	existingCmd, existingCmdFound := cmds.cmds[trigger]
+	existingCmd, existingCmdFound := ch.cmds.cmds[trigger]
 	if existingCmdFound && !existingCmd.removable {
 		return "I'm afraid I can't modify that command"
 	}
-	cmds.store.Add(trigger, msg)
-	cmds.cmds[trigger] = &command{func(_ *User, _ string) string { return msg }, false, true}
+	if actual, ok := ch.cmds.aliases[trigger]; ok {
+		return fmt.Sprintf("!%s is already an alias for !%s", trigger, actual)
+	}
+	if _, err := parseTemplate(msg); err != nil {
+		return fmt.Sprintf("Can't add !%s: %s", trigger, err)
+	}
+	now := time.Now()
+	tx := ch.cmds.store.Begin()
+	defer tx.Rollback()
+	cc, _ := loadCustomCommand(tx.Load, trigger)
+	if cc.Created.IsZero() {
+		cc = customCommand{CreatorID: u.ID, CreatorName: u.Name, Created: now}
+	}
+	cc.Response, cc.Updated = msg, now
+	if err := tx.Put(trigger, cc); err != nil {
+		return errSaving(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return errSaving(err)
+	}
+	ch.cmds.cmds[trigger] = newCustomCommand(trigger)
 	return ""
 }
 
-func cmdRemoveCommand(_ *User, data string) string {
-	cmds.Lock()
-	defer cmds.Unlock()
+func cmdRemoveCommand(ch *channel, _ *User, data string) string {
+	ch.cmds.Lock()
+	defer ch.cmds.Unlock()
 	v := split(data, 2)
 	trigger := strings.TrimPrefix(v[0], "!")
-	existingCommand, existingCommandFound := cmds.cmds[trigger]
+	existingCommand, existingCommandFound := ch.cmds.cmds[trigger]
 	if existingCommandFound && !existingCommand.removable {
 		return "I'm afraid I can't remove that command"
 	}
-	cmds.store.Remove(trigger)
-	delete(cmds.cmds, trigger)
+	if err := ch.cmds.store.Remove(trigger); err != nil {
+		return errSaving(err)
+	}
+	delete(ch.cmds.cmds, trigger)
+	ch.cmds.dropUses(trigger)
+
+	// Settings go with the command, so a new one by the same name starts afresh
+	if _, ok := ch.cmds.levels[trigger]; ok {
+		if err := ch.cmds.levelStore.Remove(trigger); err != nil {
+			return errSaving(err)
+		}
+		delete(ch.cmds.levels, trigger)
+	}
+	if _, ok := ch.cmds.cooldowns[trigger]; ok {
+		if err := ch.cmds.cooldownStore.Remove(trigger); err != nil {
+			return errSaving(err)
+		}
+		delete(ch.cmds.cooldowns, trigger)
+	}
+	for _, alias := range append([]string(nil), ch.cmds.rAliases[trigger]...) {
+		if err := ch.cmds.aliasStore.Remove(alias); err != nil {
+			return errSaving(err)
+		}
+		ch.cmds.unalias(alias)
+	}
 	return ""
 }
 
-func cmdIncrement(_ *User, data string) string {
-	cmds.Lock()
-	defer cmds.Unlock()
+func cmdIncrement(ch *channel, _ *User, data string) string {
+	ch.cmds.Lock()
+	defer ch.cmds.Unlock()
 
 	data = strings.Replace(strings.ToLower(data), " ", "-", -1)
 
 	count := 0
-	if v, ok := counters.Get(data); ok {
+	if v, ok := ch.counters.Get(data); ok {
 		count, _ = strconv.Atoi(v)
-	} else if _, ok := cmds.cmds[data]; ok {
+	} else if _, ok := ch.cmds.cmds[data]; ok {
 		return fmt.Sprintf("Can't use %q as a counter, it's already a command!", data)
+	} else if actual, ok := ch.cmds.aliases[data]; ok {
+		return fmt.Sprintf("Can't use %q as a counter, it's already an alias for !%s", data, actual)
 	}
 	count++
 
-	counters.Add(data, strconv.Itoa(count))
-	cmds.cmds[data] = &command{cmdCounter(data), false, false}
+	if err := ch.counters.Add(data, strconv.Itoa(count)); err != nil {
+		return errSaving(err)
+	}
+	ch.cmds.cmds[data] = newCounterCommand(data)
 	return fmt.Sprintf("%d", count)
 }
 
-func cmdDecrement(_ *User, data string) string {
-	cmds.Lock()
-	defer cmds.Unlock()
+func cmdDecrement(ch *channel, _ *User, data string) string {
+	ch.cmds.Lock()
+	defer ch.cmds.Unlock()
 
 	data = strings.Replace(strings.ToLower(data), " ", "-", -1)
 
 	count := 0
-	if v, ok := counters.Get(data); ok {
+	if v, ok := ch.counters.Get(data); ok {
 		count, _ = strconv.Atoi(v)
-	} else if _, ok := cmds.cmds[data]; ok {
+	} else if _, ok := ch.cmds.cmds[data]; ok {
 		return fmt.Sprintf("Can't use %q as a counter, it's already a command!", data)
+	} else if actual, ok := ch.cmds.aliases[data]; ok {
+		return fmt.Sprintf("Can't use %q as a counter, it's already an alias for !%s", data, actual)
 	}
 	count--
 
-	counters.Add(data, strconv.Itoa(count))
-	cmds.cmds[data] = &command{cmdCounter(data), false, false}
+	if err := ch.counters.Add(data, strconv.Itoa(count)); err != nil {
+		return errSaving(err)
+	}
+	ch.cmds.cmds[data] = newCounterCommand(data)
 	return fmt.Sprintf("%d", count)
 }
 
-func cmdReset(_ *User, data string) string {
-	cmds.Lock()
-	defer cmds.Unlock()
+func cmdReset(ch *channel, _ *User, data string) string {
+	ch.cmds.Lock()
+	defer ch.cmds.Unlock()
 
 	data = strings.Replace(strings.ToLower(data), " ", "-", -1)
 
-	if _, ok := counters.Get(data); !ok {
+	if _, ok := ch.counters.Get(data); !ok {
 		return "That counter doesn't exist"
 	}
 
-	counters.Remove(data)
-	delete(cmds.cmds, data)
+	if err := ch.counters.Remove(data); err != nil {
+		return errSaving(err)
+	}
+	delete(ch.cmds.cmds, data)
 	return "Removed counter"
 }
 
-func cmdCounter(k string) func(*User, string) string {
-	return func(_ *User, _ string) string {
-		v, _ := counters.Get(k)
+func cmdCounter(k string) func(*channel, *User, string) string {
+	return func(ch *channel, _ *User, _ string) string {
+		v, _ := ch.counters.Get(k)
 		if v == "" {
 			v = "0"
 		}
@@ -279,11 +427,11 @@ func cmdCounter(k string) func(*User, string) string {
 	}
 }
 
-func cmdOpen(_ *User, data string) string {
-	cmds.Lock()
-	defer cmds.Unlock()
+func cmdOpen(ch *channel, _ *User, data string) string {
+	ch.cmds.Lock()
+	defer ch.cmds.Unlock()
 
-	if cmds.currentBet != nil {
+	if ch.cmds.currentBet != nil {
 		return "A bet is already ongoing"
 	}
 
@@ -303,53 +451,54 @@ func cmdOpen(_ *User, data string) string {
 		return "Invalid !open. Must have 2+ choices"
 	}
 
-	cmds.currentBet = map[string]map[string]int{}
+	ch.cmds.currentBet = map[string]map[string]int{}
+	ch.cmds.betID = newCorrelationID()
 	for _, v := range choices {
-		cmds.currentBet[v] = map[string]int{}
+		ch.cmds.currentBet[v] = map[string]int{}
 	}
-	cmds.bettingOpen = true
+	ch.cmds.bettingOpen = true
 
 	return fmt.Sprintf("Betting is now open! %s Choices are: \"%s\". Use !bet <choice> <amount> to join!", reason, strings.Join(choices[:len(choices)-1], `", "`)+`", or "`+choices[len(choices)-1])
 }
 
-func cmdClose(_ *User, _ string) string {
-	cmds.Lock()
-	defer cmds.Unlock()
+func cmdClose(ch *channel, _ *User, _ string) string {
+	ch.cmds.Lock()
+	defer ch.cmds.Unlock()
 
-	if cmds.currentBet == nil {
+	if ch.cmds.currentBet == nil {
 		return "No bet is ongoing right now"
 	}
-	if !cmds.bettingOpen {
+	if !ch.cmds.bettingOpen {
 		return ""
 	}
 
-	cmds.bettingOpen = false
+	ch.cmds.bettingOpen = false
 	return "Betting is now closed! Good luck to all the entrants!"
 }
 
-func cmdPayout(_ *User, data string) string {
-	cmds.Lock()
-	defer cmds.Unlock()
+func cmdPayout(ch *channel, _ *User, data string) string {
+	ch.cmds.Lock()
+	defer ch.cmds.Unlock()
 
-	if cmds.currentBet == nil {
+	if ch.cmds.currentBet == nil {
 		return "No bet is ongoing right now"
 	}
-	if cmds.bettingOpen {
+	if ch.cmds.bettingOpen {
 		return "Betting isn't closed, sure hope you didn't forget to do that..."
 	}
 
 	choices := []string{}
-	for k := range cmds.currentBet {
+	for k := range ch.cmds.currentBet {
 		choices = append(choices, k)
 	}
 
-	winners, ok := cmds.currentBet[strings.ToLower(data)]
+	winners, ok := ch.cmds.currentBet[strings.ToLower(data)]
 	if !ok {
 		return "Invalid winning choice. Valid choices: " + strings.Join(choices[:len(choices)-1], `", "`) + `", or "` + choices[len(choices)-1]
 	}
 
 	payout := 0
-	for _, m := range cmds.currentBet {
+	for _, m := range ch.cmds.currentBet {
 		for _, amount := range m {
 			payout += amount
 		}
@@ -360,33 +509,60 @@ func cmdPayout(_ *User, data string) string {
 		winnerTotal += amount
 	}
 
+	tx := ch.ledger.Begin(ch.cmds.betID)
+	defer tx.Rollback()
 	for user, amount := range winners {
-		b, _ := balances.Get(user)
-		balance, _ := strconv.Atoi(b)
-		if balance <= 0 {
-			balance = 1000
-		}
-
 		earnings := int(math.Ceil((float64(amount) / float64(winnerTotal)) * float64(payout)))
-		balances.Add(user, strconv.Itoa(balance+earnings))
+		tx.Change(user, earnings, fmt.Sprintf("payout for %q", strings.ToLower(data)))
+	}
+	// Leave the bet open on failure so the payout can be tried again
+	if err := tx.Commit(); err != nil {
+		return errSaving(err)
 	}
 
-	cmds.currentBet = nil
+	ch.cmds.currentBet = nil
 	return fmt.Sprintf("Congrats and condolences: %d %s were paid out to %d winners! ", payout, CURRENCY_NAME, len(winners))
 }
 
-func cmdBet(u *User, data string) string {
-	cmds.Lock()
-	defer cmds.Unlock()
+func cmdCancel(ch *channel, _ *User, _ string) string {
+	ch.cmds.Lock()
+	defer ch.cmds.Unlock()
+
+	if ch.cmds.currentBet == nil {
+		return "No bet is ongoing right now"
+	}
+
+	tx := ch.ledger.Begin(ch.cmds.betID)
+	defer tx.Rollback()
+	refunds := 0
+	for choice, m := range ch.cmds.currentBet {
+		for user, amount := range m {
+			// Straight back, without topping up, so it's as if the bet never happened
+			tx.add(user, amount, fmt.Sprintf("refund of bet on %q", choice))
+			refunds++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errSaving(err)
+	}
+
+	ch.cmds.currentBet = nil
+	ch.cmds.bettingOpen = false
+	return fmt.Sprintf("The bet is off! %d bets were refunded", refunds)
+}
+
+func cmdBet(ch *channel, u *User, data string) string {
+	ch.cmds.Lock()
+	defer ch.cmds.Unlock()
 
-	if cmds.currentBet == nil {
+	if ch.cmds.currentBet == nil {
 		return "No bet is ongoing right now"
 	}
-	if !cmds.bettingOpen {
+	if !ch.cmds.bettingOpen {
 		return "Betting already closed, sorry!"
 	}
 
-	for choice, m := range cmds.currentBet {
+	for choice, m := range ch.cmds.currentBet {
 		for uid, amount := range m {
 			if uid == u.ID {
 				return fmt.Sprintf("%s: You already bet %d %s on %q!", u.Name, amount, CURRENCY_NAME, choice)
@@ -400,43 +576,75 @@ func cmdBet(u *User, data string) string {
 	if err != nil {
 		return u.Name + ": Invalid amount, make sure it's a number without commas or decimals"
 	}
+	if amount <= 0 {
+		return "Usage: !bet <choice> <amount>"
+	}
 
-	m, ok := cmds.currentBet[choice]
+	m, ok := ch.cmds.currentBet[choice]
 	if !ok {
 		return u.Name + ": Invalid choice, double check the list of options!"
 	}
 
-	b, _ := balances.Get(u.ID)
-	balance, _ := strconv.Atoi(b)
-	if balance <= 0 {
-		balance = 1000
-	}
-
+	tx := ch.ledger.Begin(ch.cmds.betID)
+	defer tx.Rollback()
+	balance := tx.Balance(u.ID)
 	if amount > balance {
 		return fmt.Sprintf("%s: You don't have enough %s to bet that much! Limit yourself to %d %s", u.Name, CURRENCY_NAME, balance, CURRENCY_NAME)
 	}
 
 	balance -= amount
+	tx.Change(u.ID, -amount, fmt.Sprintf("bet on %q", choice))
+	if err := tx.Commit(); err != nil {
+		return errSaving(err)
+	}
 	m[u.ID] = amount
-	balances.Add(u.ID, strconv.Itoa(balance))
 
 	return fmt.Sprintf("%s: You bet %d %s on %q and have %d %s remaining", u.Name, amount, CURRENCY_NAME, choice, balance, CURRENCY_NAME)
 }
 
-func cmdBalance(u *User, data string) string {
-	cmds.Lock()
-	defer cmds.Unlock()
+func cmdBalance(ch *channel, u *User, data string) string {
+	ch.cmds.Lock()
+	defer ch.cmds.Unlock()
+
+	return fmt.Sprintf("%s has %d %s!", u.Name, ch.ledger.Balance(u.ID), CURRENCY_NAME)
+}
 
-	b, _ := balances.Get(u.ID)
-	balance, _ := strconv.Atoi(b)
-	if balance <= 0 {
-		balance = 1000
+func cmdGive(ch *channel, u *User, data string) string {
+	v := split(data, 2)
+	amount, err := strconv.Atoi(strings.TrimSpace(v[1]))
+	if v[0] == "" || err != nil || amount <= 0 {
+		return "Usage: !give <user> <amount>"
+	}
+	target, err := getUser("", strings.TrimPrefix(v[0], "@"))
+	if err != nil {
+		log.Printf("cmdGive=%v", err)
+		return "I couldn't find that user"
+	}
+	if target.ID == u.ID {
+		return u.Name + ": You can't give to yourself!"
 	}
 
-	return fmt.Sprintf("%s has %d %s!", u.Name, balance, CURRENCY_NAME)
+	ch.cmds.Lock()
+	defer ch.cmds.Unlock()
+
+	// Both sides change together or not at all
+	tx := ch.ledger.Begin(newCorrelationID())
+	defer tx.Rollback()
+	// Only what's actually stored can be given. Empty balances count as
+	// topped up, and giving that away would mint currency.
+	stored := tx.total(u.ID)
+	if amount > stored {
+		return fmt.Sprintf("%s: You can give at most %d %s", u.Name, max(stored, 0), CURRENCY_NAME)
+	}
+	tx.add(u.ID, -amount, "gave to "+target.DisplayName)
+	tx.Change(target.ID, amount, "given by "+u.Name)
+	if err := tx.Commit(); err != nil {
+		return errSaving(err)
+	}
+	return fmt.Sprintf("%s gave %d %s to %s!", u.Name, amount, CURRENCY_NAME, target.DisplayName)
 }
 
-func cmdRoll(_ *User, data string) string {
+func cmdRoll(_ *channel, _ *User, data string) string {
 	const ErrInvalidFormat = "Invalid roll. Use format: 1d6"
 	rolls := []int{}
 	for _, die := range strings.Split(strings.ToLower(data), " ") {
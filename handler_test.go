@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testChannel builds a channel with in-memory stores, from a scratch directory
+// so nothing is left behind in the tree.
+func testChannel(t *testing.T) *channel {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	storage := STORAGE
+	STORAGE = storageMemory
+	t.Cleanup(func() { STORAGE = storage })
+
+	ch := &channel{Name: "test", RoomID: "1", counters: newMemStore()}
+	ch.cmds = newCommands(ch)
+	return ch
+}
+
+func TestRemoveCommandClearsSettings(t *testing.T) {
+	ch := testChannel(t)
+	mod := &User{"2", "Mod", "mod", levelModerator}
+	cmdAddCommand(ch, mod, "hello hi there")
+	cmdCooldown(ch, mod, "hello 30s")
+	cmdAlias(ch, mod, "add hi hello")
+	ch.cmds.Lock()
+	ch.cmds.levels["hello"] = levelModerator
+	ch.cmds.levelStore.Add("hello", levelModerator.String())
+	ch.cmds.Unlock()
+
+	cmdRemoveCommand(ch, mod, "hello")
+	if _, ok := ch.cmds.cooldowns["hello"]; ok {
+		t.Error("cooldown was left behind")
+	}
+	if _, ok := ch.cmds.levels["hello"]; ok {
+		t.Error("level was left behind")
+	}
+	if _, ok := ch.cmds.aliases["hi"]; ok {
+		t.Error("alias was left behind")
+	}
+	for _, s := range []Storage{ch.cmds.cooldownStore, ch.cmds.levelStore, ch.cmds.aliasStore} {
+		if keys := s.Keys(); len(keys) > 0 {
+			t.Errorf("saved settings were left behind: %v", keys)
+		}
+	}
+
+	// A new command by the same name starts without them
+	cmdAddCommand(ch, mod, "hello hi again")
+	if !ch.cmds.Cooldown("hello", "3", false) || !ch.cmds.Cooldown("hello", "3", false) {
+		t.Error("new command inherited the old cooldown")
+	}
+}
+
+func TestAddCommandRejectsAlias(t *testing.T) {
+	ch := testChannel(t)
+	mod := &User{"2", "Mod", "mod", levelModerator}
+	cmdAddCommand(ch, mod, "hello hi there")
+	cmdAlias(ch, mod, "add hi hello")
+
+	if resp := cmdAddCommand(ch, mod, "hi something else"); resp == "" {
+		t.Error("added a command over an alias")
+	}
+	if _, ok := ch.cmds.cmds["hi"]; ok {
+		t.Error("command was added under an alias's name")
+	}
+}
+
+func TestBetRejectsNonPositive(t *testing.T) {
+	ch := testChannel(t)
+	ch.ledger = newLedger(newMemStore(), newMemStore())
+	ch.cmds.currentBet = map[string]map[string]int{"yes": {}, "no": {}}
+	ch.cmds.bettingOpen = true
+	u := &User{"3", "Viewer", "viewer", levelEveryone}
+
+	for _, amount := range []string{"-5000", "0"} {
+		cmdBet(ch, u, "yes "+amount)
+		if _, ok := ch.cmds.currentBet["yes"][u.ID]; ok {
+			t.Errorf("bet of %s was accepted", amount)
+		}
+	}
+	if b := ch.ledger.Balance(u.ID); b != startingBalance {
+		t.Errorf("balance is %d after rejected bets, want %d", b, startingBalance)
+	}
+}
+
+func TestCustomCommandUsesAreFlushed(t *testing.T) {
+	ch := testChannel(t)
+	mod := &User{"2", "Mod", "mod", levelModerator}
+	cmdAddCommand(ch, mod, "hello hi there")
+
+	writes := 0
+	ch.cmds.store.(*memStore).save = func(map[string]json.RawMessage) error {
+		writes++
+		return nil
+	}
+	for i := 0; i < 3; i++ {
+		if resp := ch.cmds.Get("hello").fn(ch, mod, ""); resp != "hi there" {
+			t.Fatalf("!hello said %q", resp)
+		}
+	}
+	if writes != 0 {
+		t.Errorf("using the command wrote to the store %d times", writes)
+	}
+	if resp := cmdShowCommand(ch, mod, "hello"); !strings.Contains(resp, "used 3 times") {
+		t.Errorf("!showcommand said %q before a flush", resp)
+	}
+
+	if err := ch.cmds.flushUses(); err != nil {
+		t.Fatal(err)
+	}
+	if writes != 1 {
+		t.Errorf("flush wrote %d times, want 1", writes)
+	}
+	cc, _ := loadCustomCommand(ch.cmds.store.Load, "hello")
+	if cc.Uses != 3 {
+		t.Errorf("saved uses is %d, want 3", cc.Uses)
+	}
+}
+
+func TestCounterRejectsAlias(t *testing.T) {
+	ch := testChannel(t)
+	mod := &User{"2", "Mod", "mod", levelModerator}
+	cmdAddCommand(ch, mod, "hello hi there")
+	cmdAlias(ch, mod, "add hi hello")
+
+	for _, fn := range []func(*channel, *User, string) string{cmdIncrement, cmdDecrement} {
+		fn(ch, mod, "hi")
+		if _, ok := ch.counters.Get("hi"); ok {
+			t.Error("counter was created under an alias's name")
+		}
+		if _, ok := ch.cmds.cmds["hi"]; ok {
+			t.Error("counter command was added under an alias's name")
+		}
+	}
+}
+
+func TestOnlyCallerResponsesAreReplies(t *testing.T) {
+	ch := testChannel(t)
+	ch.chatters = make(map[string]bool)
+	channels.Lock()
+	channels.m[ch.RoomID] = ch
+	channels.Unlock()
+	t.Cleanup(func() {
+		channels.Lock()
+		delete(channels.m, ch.RoomID)
+		channels.Unlock()
+	})
+	cmdAddCommand(ch, &User{"2", "Mod", "mod", levelModerator}, "hello hi there")
+
+	for text, reply := range map[string]bool{"!roll d6": true, "!hello": false} {
+		out := newOutbox()
+		handle(out, &message{ID: "abc", Command: "PRIVMSG", RoomID: ch.RoomID, UserID: "3", Args: []string{"#test", text}})
+		m, err := parse([]byte(<-out.queue))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Tags["reply-parent-msg-id"] == "abc"; got != reply {
+			t.Errorf("%s: threaded as a reply is %v, want %v", text, got, reply)
+		}
+	}
+}
+
+func TestAddQuoteBeforeFirstPoll(t *testing.T) {
+	ch := testChannel(t)
+	ch.quotes = newMemStore()
+	cmdAddQuote(ch, &User{"2", "Mod", "mod", levelModerator}, "hello")
+
+	var q quote
+	if !ch.quotes.Load("0", &q) || q.Text != "hello" {
+		t.Fatalf("quote 0 is %+v", q)
+	}
+	if q.Game != "" {
+		t.Errorf("game is %q before the stream state was loaded, want none", q.Game)
+	}
+}
+
+func TestCooldownForgetsExpiredUsers(t *testing.T) {
+	ch := testChannel(t)
+	mod := &User{"2", "Mod", "mod", levelModerator}
+	cmdAddCommand(ch, mod, "hello hi there")
+	cmdCooldown(ch, mod, "hello 0s 1m")
+
+	ch.cmds.Cooldown("hello", "3", false)
+	ch.cmds.Cooldown("hello", "4", false)
+	ch.cmds.Lock()
+	ch.cmds.lastUsedBy["hello 3"] = time.Now().Add(-2 * time.Minute)
+	ch.cmds.lastSweep = time.Time{}
+	ch.cmds.Unlock()
+
+	ch.cmds.Cooldown("hello", "5", false)
+	if _, ok := ch.cmds.lastUsedBy["hello 3"]; ok {
+		t.Error("expired use was kept")
+	}
+	if _, ok := ch.cmds.lastUsedBy["hello 4"]; !ok {
+		t.Error("use still on cooldown was dropped")
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Refresh app tokens this long before Twitch says they expire
+const tokenExpiryMargin = 5 * time.Minute
+
+var errUnauthorized = errors.New("helix: unauthorized")
+
+// tokenSource returns an access token, fetching a new one when force is set
+// because the last one was rejected.
+type tokenSource func(force bool) (string, error)
+
+type helixClient struct {
+	sync.Mutex
+	token   string
+	expires time.Time
+
+	rateLock      sync.Mutex
+	rateRemaining int
+	rateReset     time.Time
+}
+
+var helix = &helixClient{rateRemaining: -1}
+
+// appToken gets an app access token with the client credentials flow
+func (h *helixClient) appToken(force bool) (string, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	if !force && h.token != "" && time.Now().Before(h.expires) {
+		return h.token, nil
+	}
+
+	q := url.Values{
+		"client_id":     {CLIENT_ID},
+		"client_secret": {CLIENT_SECRET},
+		"grant_type":    {"client_credentials"},
+	}
+	resp, err := http.PostForm(OAUTH_URL+"/token", q)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("app token: %s", resp.Status)
+	}
+
+	var data struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return "", err
+	}
+	h.token = data.AccessToken
+	h.expires = time.Now().Add(time.Duration(data.ExpiresIn)*time.Second - tokenExpiryMargin)
+	return h.token, nil
+}
+
+// waitForRateLimit blocks while the bucket reported by Twitch is empty
+func (h *helixClient) waitForRateLimit() {
+	h.rateLock.Lock()
+	wait := time.Duration(0)
+	if h.rateRemaining == 0 {
+		wait = time.Until(h.rateReset)
+	}
+	h.rateLock.Unlock()
+	if wait > 0 {
+		log.Printf("Helix rate limit reached, waiting %v", roundToSeconds(wait))
+		time.Sleep(wait)
+	}
+}
+
+func (h *helixClient) updateRateLimit(resp *http.Response) {
+	remaining, err1 := strconv.Atoi(resp.Header.Get("Ratelimit-Remaining"))
+	reset, err2 := strconv.ParseInt(resp.Header.Get("Ratelimit-Reset"), 10, 64)
+	if err1 != nil || err2 != nil {
+		return
+	}
+	h.rateLock.Lock()
+	defer h.rateLock.Unlock()
+	h.rateRemaining = remaining
+	h.rateReset = time.Unix(reset, 0)
+}
+
+// do calls a Helix endpoint, decoding the JSON response into data if it's
+// not nil. A 401 gets one retry with a fresh token, a 429 one retry after
+// the rate limit resets.
+func (h *helixClient) do(tokens tokenSource, method, path string, query url.Values, body, data interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	u := HELIX_URL + "/" + strings.TrimPrefix(path, "/")
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	force := false
+	lastErr := error(nil)
+	for attempt := 0; attempt < 2; attempt++ {
+		token, err := tokens(force)
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequest(method, u, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Add("Client-ID", CLIENT_ID)
+		req.Header.Add("Authorization", "Bearer "+token)
+		if body != nil {
+			req.Header.Add("Content-Type", "application/json")
+		}
+
+		h.waitForRateLimit()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		h.updateRateLimit(resp)
+
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized:
+			resp.Body.Close()
+			force = true
+			lastErr = errUnauthorized
+			continue
+		case resp.StatusCode == http.StatusTooManyRequests:
+			resp.Body.Close()
+			lastErr = fmt.Errorf("helix %s %s: %s", method, path, resp.Status)
+			continue
+		case resp.StatusCode >= 300:
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			resp.Body.Close()
+			return fmt.Errorf("helix %s %s: %s %s", method, path, resp.Status, bytes.TrimSpace(msg))
+		}
+
+		defer resp.Body.Close()
+		if data == nil || resp.StatusCode == http.StatusNoContent {
+			return nil
+		}
+		return json.NewDecoder(resp.Body).Decode(data)
+	}
+	return lastErr
+}
+
+// get calls a Helix endpoint with the app token
+func (h *helixClient) get(data interface{}, path string, query url.Values) error {
+	return h.do(h.appToken, "GET", path, query, nil, data)
+}
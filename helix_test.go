@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTwitch serves the OAuth token endpoint, handing out tok1, tok2 and so
+// on, and passes Helix requests to helixFn.
+type fakeTwitch struct {
+	sync.Mutex
+	tokens   int
+	requests []time.Time
+	helixFn  func(w http.ResponseWriter, r *http.Request, n int)
+}
+
+func newFakeTwitch(t *testing.T, helixFn func(w http.ResponseWriter, r *http.Request, n int)) (*fakeTwitch, *helixClient) {
+	f := &fakeTwitch{helixFn: helixFn}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.Lock()
+		defer f.Unlock()
+		if r.URL.Path == "/oauth2/token" {
+			f.tokens++
+			fmt.Fprintf(w, `{"access_token":"tok%d","expires_in":3600}`, f.tokens)
+			return
+		}
+		f.requests = append(f.requests, time.Now())
+		f.helixFn(w, r, len(f.requests))
+	}))
+	t.Cleanup(srv.Close)
+
+	helixURL, oauthURL := HELIX_URL, OAUTH_URL
+	HELIX_URL, OAUTH_URL = srv.URL+"/helix", srv.URL+"/oauth2"
+	t.Cleanup(func() { HELIX_URL, OAUTH_URL = helixURL, oauthURL })
+	return f, &helixClient{rateRemaining: -1}
+}
+
+func TestHelixRefreshesRejectedToken(t *testing.T) {
+	f, h := newFakeTwitch(t, func(w http.ResponseWriter, r *http.Request, n int) {
+		if r.Header.Get("Authorization") != "Bearer tok2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"data":[{"id":"1"}]}`)
+	})
+
+	var data struct {
+		Data []struct{ ID string } `json:"data"`
+	}
+	if err := h.get(&data, "users", nil); err != nil {
+		t.Fatal(err)
+	}
+	if f.tokens != 2 || len(f.requests) != 2 {
+		t.Errorf("%d tokens and %d requests, want a forced refresh and one retry", f.tokens, len(f.requests))
+	}
+	if len(data.Data) != 1 || data.Data[0].ID != "1" {
+		t.Errorf("got %+v", data)
+	}
+
+	// A token that's rejected again isn't retried forever
+	f.helixFn = func(w http.ResponseWriter, r *http.Request, n int) { w.WriteHeader(http.StatusUnauthorized) }
+	if err := h.get(nil, "users", nil); err != errUnauthorized {
+		t.Errorf("err is %v, want errUnauthorized", err)
+	}
+}
+
+func TestHelixRetriesAfterRateLimitReset(t *testing.T) {
+	reset := time.Now().Add(time.Second).Unix() + 1
+	f, h := newFakeTwitch(t, func(w http.ResponseWriter, r *http.Request, n int) {
+		if n == 1 {
+			w.Header().Set("Ratelimit-Remaining", "0")
+			w.Header().Set("Ratelimit-Reset", strconv.FormatInt(reset, 10))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Ratelimit-Remaining", "799")
+		w.Header().Set("Ratelimit-Reset", strconv.FormatInt(reset+60, 10))
+		fmt.Fprint(w, `{"data":[]}`)
+	})
+
+	if err := h.get(nil, "users", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.requests) != 2 {
+		t.Fatalf("%d requests, want a retry after the 429", len(f.requests))
+	}
+	if f.requests[1].Before(time.Unix(reset, 0)) {
+		t.Errorf("retried at %v, before the reset at %v", f.requests[1], time.Unix(reset, 0))
+	}
+}
+
+func TestHelixWaitsForRateLimitReset(t *testing.T) {
+	reset := time.Now().Add(time.Second).Unix() + 1
+	f, h := newFakeTwitch(t, func(w http.ResponseWriter, r *http.Request, n int) {
+		w.Header().Set("Ratelimit-Remaining", "0")
+		w.Header().Set("Ratelimit-Reset", strconv.FormatInt(reset, 10))
+		fmt.Fprint(w, `{"data":[]}`)
+	})
+
+	// The first call empties the bucket, so the second has to wait for it
+	for i := 0; i < 2; i++ {
+		if err := h.get(nil, "users", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f.requests[1].Before(time.Unix(reset, 0)) {
+		t.Errorf("second request at %v, before the reset at %v", f.requests[1], time.Unix(reset, 0))
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import "sort"
+
+// commandInfo describes a command for !help and the web dashboard
+type commandInfo struct {
+	Name        string
+	Description string
+	Usage       string
+	Level       level
+	Aliases     []string
+	Custom      bool
+}
+
+func (c *commands) info(name string) commandInfo {
+	cmd := c.cmds[name]
+	aliases := append([]string{}, c.rAliases[name]...)
+	sort.Strings(aliases)
+	return commandInfo{
+		Name:        name,
+		Description: cmd.description,
+		Usage:       cmd.usage,
+		Level:       c.level(name),
+		Aliases:     aliases,
+		Custom:      cmd.removable,
+	}
+}
+
+// Info describes a single command, following aliases
+func (c *commands) Info(name string) (commandInfo, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	name = c.resolve(name)
+	if _, ok := c.cmds[name]; !ok {
+		return commandInfo{}, false
+	}
+	return c.info(name), true
+}
+
+// List describes every command, sorted by name
+func (c *commands) List() []commandInfo {
+	c.RLock()
+	defer c.RUnlock()
+	names := make([]string, 0, len(c.cmds))
+	for k := range c.cmds {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	infos := make([]commandInfo, 0, len(names))
+	for _, name := range names {
+		infos = append(infos, c.info(name))
+	}
+	return infos
+}
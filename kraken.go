@@ -1,104 +1,216 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
-	"net/http"
 	"net/url"
 	"strings"
 	"sync"
 	"time"
 )
 
-func kraken(data interface{}, path ...string) error {
-	url := strings.Join(append([]string{"https://api.twitch.tv/kraken"}, path...), "/")
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return err
+func roundToSeconds(d time.Duration) time.Duration {
+	return ((d + time.Second/2) / time.Second) * time.Second
+}
+
+func getUptime(ch *channel) string {
+	s := ch.Stream()
+	if !s.Live {
+		return fmt.Sprintf("%s is not online", ch.Name)
 	}
+	return roundToSeconds(time.Since(s.StartedAt)).String()
+}
 
-	req.Header.Add("Client-ID", CLIENT_ID)
+func getGame(ch *channel, rating bool) string {
+	s := ch.Stream()
+	if s.Updated.IsZero() {
+		return "API is down"
+	}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
+	if rating {
+		return getRating(s.Game)
 	}
-	defer resp.Body.Close()
+	return s.Game
+}
 
-	return json.NewDecoder(resp.Body).Decode(data)
+// getFollowedAt returns when a user followed the channel, if they do.
+// Twitch only shares this with the broadcaster or their mods, so it needs the
+// broadcaster's token. Without one it's unknown and errNoUserToken is returned.
+func getFollowedAt(ch *channel, userID string) (time.Time, bool, error) {
+	var data struct {
+		Data []struct {
+			FollowedAt time.Time `json:"followed_at"`
+		} `json:"data"`
+	}
+	if _, err := ch.broadcasterToken(false); err != nil {
+		return time.Time{}, false, err
+	}
+	q := url.Values{"broadcaster_id": {ch.RoomID}, "user_id": {userID}}
+	if err := helix.do(ch.broadcasterToken, "GET", "channels/followers", q, nil, &data); err != nil {
+		return time.Time{}, false, err
+	}
+	if len(data.Data) == 0 {
+		return time.Time{}, false, nil
+	}
+	return data.Data[0].FollowedAt, true, nil
 }
 
-func roundToSeconds(d time.Duration) time.Duration {
-	return ((d + time.Second/2) / time.Second) * time.Second
+const followCacheTime = 10 * time.Minute
+
+var follows = struct {
+	sync.Mutex
+	m map[string]followCacheEntry
+}{m: make(map[string]followCacheEntry)}
+
+type followCacheEntry struct {
+	followedAt time.Time
+	following  bool
+	checked    time.Time
 }
 
-func getUptime(channel string) string {
-	var data struct {
-		Stream *struct {
-			CreatedAt time.Time `json:"created_at"`
-		}
+// followedAt is getFollowedAt with a short per-user cache, since follower
+// permission checks and !followage can ask for the same user repeatedly.
+// Failures aren't cached.
+func followedAt(ch *channel, userID string) (time.Time, bool, error) {
+	if userID == "" {
+		return time.Time{}, false, nil
 	}
-	err := kraken(&data, "streams", channel)
-	if err != nil || data.Stream == nil {
-		log.Printf("getUptime=%v", err)
-		return fmt.Sprintf("%s is not online", channel)
+	key := ch.RoomID + " " + userID
+
+	follows.Lock()
+	e, ok := follows.m[key]
+	follows.Unlock()
+	if ok && time.Since(e.checked) < followCacheTime {
+		return e.followedAt, e.following, nil
 	}
 
-	// if t, err := time.Parse(time.RFC3339, u); err == nil {}
-	return roundToSeconds(time.Since(data.Stream.CreatedAt)).String()
+	t, following, err := getFollowedAt(ch, userID)
+	if err != nil {
+		return t, following, err
+	}
+	follows.Lock()
+	follows.m[key] = followCacheEntry{t, following, time.Now()}
+	follows.Unlock()
+	return t, following, nil
 }
 
-func getGame(channel string, rating bool) string {
+type twitchUser struct {
+	ID          string    `json:"id"`
+	Login       string    `json:"login"`
+	DisplayName string    `json:"display_name"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+var users = struct {
+	sync.Mutex
+	m map[string]*twitchUser
+}{m: make(map[string]*twitchUser)}
+
+// getUser looks a user up by ID or, if id is empty, by login. Nothing we use
+// changes often, so users are cached by ID for the life of the process.
+func getUser(id, login string) (*twitchUser, error) {
+	if id != "" {
+		users.Lock()
+		u, ok := users.m[id]
+		users.Unlock()
+		if ok {
+			return u, nil
+		}
+	}
+
+	q := url.Values{"id": {id}}
+	if id == "" {
+		q = url.Values{"login": {strings.ToLower(login)}}
+	}
 	var data struct {
-		Game string
+		Data []twitchUser `json:"data"`
 	}
-	err := kraken(&data, "channels", channel)
-	if err != nil {
-		log.Printf("getGame=%v", err)
-		return "API is down"
+	if err := helix.get(&data, "users", q); err != nil {
+		return nil, err
 	}
-
-	if rating {
-		return getRating(data.Game)
+	if len(data.Data) == 0 {
+		return nil, fmt.Errorf("no such user %q", login)
 	}
-	return data.Game
+
+	u := &data.Data[0]
+	users.Lock()
+	users.m[u.ID] = u
+	users.Unlock()
+	return u, nil
 }
 
-var ratings = struct {
-	sync.Mutex
-	m map[string]string
-}{m: make(map[string]string)}
-
-func getRating(game string) string {
-	ratings.Lock()
-	defer ratings.Unlock()
-
-	if r, ok := ratings.m[game]; ok {
-		return r
-	}
-
-	q := url.Values{
-		"count": {"1"},
-		"game":  {game},
-	}
-	if req, err := http.NewRequest("GET", "https://videogamesrating.p.mashape.com/get.php?"+q.Encode(), nil); err == nil {
-		req.Header.Add("X-Mashape-Key", MASHAPE_KEY)
-		req.Header.Add("Accept", "application/json")
-		if resp, err := http.DefaultClient.Do(req); err == nil {
-			defer resp.Body.Close()
-			var data []map[string]interface{}
-			if err := json.NewDecoder(resp.Body).Decode(&data); err == nil && len(data) > 0 {
-				if score, ok := data[0]["score"].(string); ok && score != "" {
-					r := fmt.Sprintf("%s [Rating: %s]", game, score)
-					ratings.m[game] = r
-					return r
-				}
-			} else {
-				log.Print(err)
+// humanizeDuration formats long durations the way time.Duration formats
+// short ones, e.g. 1y45d3h. Only the three largest units are kept.
+func humanizeDuration(d time.Duration) string {
+	units := []struct {
+		suffix string
+		size   time.Duration
+	}{
+		{"y", 365 * 24 * time.Hour},
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+	}
+
+	d = roundToSeconds(d)
+	s := ""
+	shown := 0
+	for _, u := range units {
+		if n := d / u.size; n > 0 || shown > 0 {
+			d -= n * u.size
+			if n > 0 {
+				s += fmt.Sprintf("%d%s", n, u.suffix)
+			}
+			if shown++; shown == 3 {
+				break
 			}
 		}
 	}
+	if s == "" {
+		return "0s"
+	}
+	return s
+}
 
-	return game
+// targetUser works out who a command is asking about: the named user if
+// there is one, otherwise whoever ran it
+func targetUser(u *User, data string) (*twitchUser, error) {
+	login := strings.TrimPrefix(split(data, 2)[0], "@")
+	if login == "" || strings.EqualFold(login, u.Login) {
+		return getUser(u.ID, u.Login)
+	}
+	return getUser("", login)
+}
+
+func cmdFollowAge(ch *channel, u *User, data string) string {
+	target, err := targetUser(u, data)
+	if err != nil {
+		log.Printf("cmdFollowAge=%v", err)
+		return "I couldn't find that user"
+	}
+	if target.ID == ch.RoomID {
+		return fmt.Sprintf("%s can't follow themselves!", target.DisplayName)
+	}
+	t, following, err := followedAt(ch, target.ID)
+	if err == errNoUserToken {
+		return "I can't see followers until the broadcaster authorizes me at " + authURL()
+	}
+	if err != nil {
+		log.Printf("cmdFollowAge=%v", err)
+		return "Twitch didn't tell me, sorry"
+	}
+	if !following {
+		return fmt.Sprintf("%s isn't following %s", target.DisplayName, ch.Name)
+	}
+	return fmt.Sprintf("%s has been following %s for %s", target.DisplayName, ch.Name, humanizeDuration(time.Since(t)))
+}
+
+func cmdAccountAge(_ *channel, u *User, data string) string {
+	target, err := targetUser(u, data)
+	if err != nil {
+		log.Printf("cmdAccountAge=%v", err)
+		return "I couldn't find that user"
+	}
+	return fmt.Sprintf("%s's account is %s old", target.DisplayName, humanizeDuration(time.Since(target.CreatedAt)))
 }
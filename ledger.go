@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Everyone starts with this much, and empty balances are topped back up to it
+const startingBalance = 1000
+
+// Chatters earn watchEarnings every watchInterval while the stream is live
+const (
+	watchInterval = 5 * time.Minute
+	watchEarnings = 10
+)
+
+// ledgerEntry is one change to a balance. Entries are never changed once
+// written, so they explain how every balance came to be.
+type ledgerEntry struct {
+	Time        time.Time `json:"time"`
+	UserID      string    `json:"user_id"`
+	Amount      int       `json:"amount"`
+	Balance     int       `json:"balance"`
+	Reason      string    `json:"reason"`
+	Correlation string    `json:"correlation"` // shared by the entries of one bet, transfer, etc
+}
+
+// ledger is the record of a channel's currency. Balances are derived from
+// the entries, and the balances store is kept only as a snapshot of them.
+type ledger struct {
+	sync.Mutex
+	entries  Storage
+	balances Storage
+	totals   map[string]int
+	byUser   map[string][]int // entry numbers for each user, oldest first
+	next     int
+}
+
+func newLedger(entries, balances Storage) *ledger {
+	l := &ledger{
+		entries:  entries,
+		balances: balances,
+		totals:   make(map[string]int),
+		byUser:   make(map[string][]int),
+	}
+	for _, k := range entries.Keys() {
+		var e ledgerEntry
+		if !entries.Load(k, &e) {
+			log.Fatalf("Ledger entry %s is unreadable, refusing to start", k)
+		}
+		l.totals[e.UserID] += e.Amount
+		l.byUser[e.UserID] = append(l.byUser[e.UserID], l.next)
+		l.next++
+	}
+	l.reconcile()
+	return l
+}
+
+func ledgerKey(n int) string {
+	return fmt.Sprintf("%010d", n)
+}
+
+// reconcile checks the balances snapshot against the ledger. Balances from
+// before the ledger existed become opening entries, anything else that
+// disagrees is put right from the ledger, which is always written first.
+func (l *ledger) reconcile() {
+	tx := l.Begin("opening")
+	for _, id := range l.balances.Keys() {
+		if _, ok := l.totals[id]; ok {
+			continue
+		}
+		v, _ := l.balances.Get(id)
+		if balance, err := strconv.Atoi(v); err == nil {
+			tx.add(id, balance, "opening balance")
+		}
+	}
+	must(tx.Commit())
+
+	btx := l.balances.Begin()
+	defer btx.Rollback()
+	for id, total := range l.totals {
+		v, _ := btx.Get(id)
+		if v != strconv.Itoa(total) {
+			log.Printf("Balance of %s was %q, the ledger says %d", id, v, total)
+			btx.Add(id, strconv.Itoa(total))
+		}
+	}
+	must(btx.Commit())
+}
+
+// Balance is what the user can spend right now
+func (l *ledger) Balance(userID string) int {
+	l.Lock()
+	defer l.Unlock()
+	return effectiveBalance(l.totals[userID])
+}
+
+func effectiveBalance(total int) int {
+	if total <= 0 {
+		return startingBalance
+	}
+	return total
+}
+
+// Entries returns up to n of the user's most recent entries, newest first
+func (l *ledger) Entries(userID string, n int) []ledgerEntry {
+	l.Lock()
+	nums := l.byUser[userID]
+	if len(nums) > n {
+		nums = nums[len(nums)-n:]
+	}
+	nums = append([]int(nil), nums...)
+	l.Unlock()
+
+	list := make([]ledgerEntry, 0, len(nums))
+	for i := len(nums) - 1; i >= 0; i-- {
+		var e ledgerEntry
+		if l.entries.Load(ledgerKey(nums[i]), &e) {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+func newCorrelationID() string {
+	return fmt.Sprintf("%08x", rand.Uint32())
+}
+
+// ledgerTx collects the entries of one operation so they're written together
+// or not at all. The ledger stays locked until Commit or Rollback.
+type ledgerTx struct {
+	l           *ledger
+	correlation string
+	entries     []ledgerEntry
+	pending     map[string]int
+	done        bool
+}
+
+func (l *ledger) Begin(correlation string) *ledgerTx {
+	l.Lock()
+	return &ledgerTx{l: l, correlation: correlation, pending: make(map[string]int)}
+}
+
+func (tx *ledgerTx) total(userID string) int {
+	if t, ok := tx.pending[userID]; ok {
+		return t
+	}
+	return tx.l.totals[userID]
+}
+
+// Balance includes the changes made so far in this transaction
+func (tx *ledgerTx) Balance(userID string) int {
+	return effectiveBalance(tx.total(userID))
+}
+
+// Change adds amount to the user's balance, first recording the top up if
+// the balance was empty.
+func (tx *ledgerTx) Change(userID string, amount int, reason string) {
+	if total := tx.total(userID); total <= 0 {
+		_, seen := tx.l.totals[userID]
+		_, seenHere := tx.pending[userID]
+		if seen || seenHere {
+			tx.add(userID, startingBalance-total, "top up")
+		} else {
+			tx.add(userID, startingBalance, "starting balance")
+		}
+	}
+	tx.add(userID, amount, reason)
+}
+
+// Deduct takes up to amount from the user's stored total and returns how
+// much it took. It never leaves the total below zero, since that reads as an
+// empty balance and would be topped straight back up.
+func (tx *ledgerTx) Deduct(userID string, amount int, reason string) int {
+	if stored := max(tx.total(userID), 0); amount > stored {
+		amount = stored
+	}
+	if amount > 0 {
+		tx.add(userID, -amount, reason)
+	}
+	return amount
+}
+
+func (tx *ledgerTx) add(userID string, amount int, reason string) {
+	total := tx.total(userID) + amount
+	tx.pending[userID] = total
+	tx.entries = append(tx.entries, ledgerEntry{time.Now(), userID, amount, total, reason, tx.correlation})
+}
+
+func (tx *ledgerTx) Commit() error {
+	if tx.done {
+		return fmt.Errorf("transaction already finished")
+	}
+	tx.done = true
+	l := tx.l
+	defer l.Unlock()
+	if len(tx.entries) == 0 {
+		return nil
+	}
+
+	etx := l.entries.Begin()
+	defer etx.Rollback()
+	for i, e := range tx.entries {
+		if err := etx.Put(ledgerKey(l.next+i), e); err != nil {
+			return err
+		}
+	}
+	if err := etx.Commit(); err != nil {
+		return err
+	}
+	for i, e := range tx.entries {
+		l.byUser[e.UserID] = append(l.byUser[e.UserID], l.next+i)
+	}
+	l.next += len(tx.entries)
+
+	btx := l.balances.Begin()
+	defer btx.Rollback()
+	for id, total := range tx.pending {
+		l.totals[id] = total
+		btx.Add(id, strconv.Itoa(total))
+	}
+	// The entries are what count, the snapshot gets fixed on the next start
+	if err := btx.Commit(); err != nil {
+		log.Printf("Failed to save balances snapshot: %v", err)
+	}
+	return nil
+}
+
+// Rollback drops the entries. It does nothing after Commit, so it can always
+// be deferred.
+func (tx *ledgerTx) Rollback() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	tx.l.Unlock()
+}
+
+// seen notes a chatter for watch earnings
+func (ch *channel) seen(userID string) {
+	if userID == "" {
+		return
+	}
+	ch.chatterLock.Lock()
+	defer ch.chatterLock.Unlock()
+	ch.chatters[userID] = true
+}
+
+func runWatchEarnings() {
+	for range time.Tick(watchInterval) {
+		channels.Lock()
+		list := make([]*channel, 0, len(channels.m))
+		for _, ch := range channels.m {
+			list = append(list, ch)
+		}
+		channels.Unlock()
+
+		for _, ch := range list {
+			payWatchers(ch)
+		}
+	}
+}
+
+// payWatchers credits everyone who chatted during the last interval
+func payWatchers(ch *channel) {
+	ch.chatterLock.Lock()
+	active := ch.chatters
+	ch.chatters = make(map[string]bool)
+	ch.chatterLock.Unlock()
+
+	if !ch.Stream().Live || len(active) == 0 {
+		return
+	}
+	tx := ch.ledger.Begin(newCorrelationID())
+	defer tx.Rollback()
+	for id := range active {
+		tx.Change(id, watchEarnings, "watching")
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("payWatchers(%s)=%v", ch.Name, err)
+	}
+}
+
+func cmdLedger(ch *channel, _ *User, data string) string {
+	login := strings.TrimPrefix(split(data, 2)[0], "@")
+	if login == "" {
+		return "Usage: !ledger <user>"
+	}
+	target, err := getUser("", login)
+	if err != nil {
+		log.Printf("cmdLedger=%v", err)
+		return "I couldn't find that user"
+	}
+
+	entries := ch.ledger.Entries(target.ID, 5)
+	if len(entries) == 0 {
+		return fmt.Sprintf("%s has no %s history", target.DisplayName, CURRENCY_NAME)
+	}
+	parts := make([]string, 0, len(entries))
+	for _, e := range entries {
+		parts = append(parts, fmt.Sprintf("%+d %s (%s ago, #%s)", e.Amount, e.Reason, humanizeDuration(time.Since(e.Time)), e.Correlation))
+	}
+	return fmt.Sprintf("%s has %d %s. Recent: %s", target.DisplayName, ch.ledger.Balance(target.ID), CURRENCY_NAME, strings.Join(parts, ", "))
+}
+
+func cmdAdjust(ch *channel, u *User, data string) string {
+	v := split(data, 3)
+	amount, err := strconv.Atoi(v[1])
+	if v[0] == "" || err != nil || amount == 0 {
+		return "Usage: !adjust <user> <+/-amount> [reason]"
+	}
+	target, err := getUser("", strings.TrimPrefix(v[0], "@"))
+	if err != nil {
+		log.Printf("cmdAdjust=%v", err)
+		return "I couldn't find that user"
+	}
+
+	reason := "mod adjustment by " + u.Name
+	if r := strings.TrimSpace(v[2]); r != "" {
+		reason += ": " + r
+	}
+	tx := ch.ledger.Begin(newCorrelationID())
+	defer tx.Rollback()
+	if amount < 0 {
+		if tx.Deduct(target.ID, -amount, reason) == 0 {
+			return fmt.Sprintf("%s has no %s to take", target.DisplayName, CURRENCY_NAME)
+		}
+	} else {
+		tx.Change(target.ID, amount, reason)
+	}
+	total := tx.total(target.ID)
+	if err := tx.Commit(); err != nil {
+		return errSaving(err)
+	}
+	return fmt.Sprintf("%s now has %d %s", target.DisplayName, total, CURRENCY_NAME)
+}
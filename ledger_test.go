@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestDeductStopsAtZero(t *testing.T) {
+	l := newLedger(newMemStore(), newMemStore())
+	tx := l.Begin("test")
+	tx.Change("1", -950, "bet")
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx = l.Begin("test")
+	if took := tx.Deduct("1", 100, "mod adjustment"); took != 50 {
+		t.Errorf("took %d from a balance of 50, want 50", took)
+	}
+	if total := tx.total("1"); total != 0 {
+		t.Errorf("total is %d after taking everything, want 0", total)
+	}
+	if took := tx.Deduct("1", 100, "mod adjustment"); took != 0 {
+		t.Errorf("took %d from an empty balance", took)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := l.Entries("1", 10)
+	if len(entries) == 0 || entries[0].Amount != -50 || entries[0].Balance != 0 {
+		t.Errorf("latest entry is %+v, want -50 leaving 0", entries)
+	}
+}
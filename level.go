@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// level is an ordered permission tier; a user may run a command when their
+// level is at least the command's.
+type level int
+
+const (
+	levelEveryone level = iota
+	levelFollower
+	levelSubscriber
+	levelVIP
+	levelModerator
+	levelBroadcaster
+	levelOwner
+)
+
+var levelNames = []string{"everyone", "follower", "subscriber", "vip", "moderator", "broadcaster", "owner"}
+
+var levelAliases = map[string]level{
+	"all":      levelEveryone,
+	"follow":   levelFollower,
+	"sub":      levelSubscriber,
+	"mod":      levelModerator,
+	"mods":     levelModerator,
+	"streamer": levelBroadcaster,
+}
+
+func (l level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+func parseLevel(s string) (level, bool) {
+	s = strings.ToLower(s)
+	for i, name := range levelNames {
+		if s == name {
+			return level(i), true
+		}
+	}
+	l, ok := levelAliases[s]
+	return l, ok
+}
+
+// userLevel works out a chatter's level from their badges. Follower can't be
+// derived from tags, so it's only looked up when a command needs it.
+func userLevel(m *message) level {
+	switch {
+	case OWNER != "" && strings.EqualFold(m.Prefix.Nick, OWNER):
+		return levelOwner
+	case m.IsBroadcaster() || m.UserID != "" && m.RoomID == m.UserID:
+		return levelBroadcaster
+	case m.Mod || m.HasBadge("moderator"):
+		return levelModerator
+	case m.IsVIP():
+		return levelVIP
+	case m.Sub || m.HasBadge("subscriber") || m.IsFounder():
+		return levelSubscriber
+	}
+	return levelEveryone
+}
+
+// allowed reports whether u may run a command requiring min
+func allowed(ch *channel, u *User, min level) bool {
+	if u.Level >= min {
+		return true
+	}
+	if min != levelFollower {
+		return false
+	}
+	// Unknown counts as not following
+	_, following, err := followedAt(ch, u.ID)
+	if err != nil && err != errNoUserToken {
+		log.Printf("allowed=%v", err)
+	}
+	return following
+}
+
+// Level returns the minimum level for the named command, including any
+// override set with !permit-level.
+func (c *commands) Level(name string) level {
+	c.RLock()
+	defer c.RUnlock()
+	return c.level(name)
+}
+
+func (c *commands) level(name string) level {
+	if l, ok := c.levels[name]; ok {
+		return l
+	}
+	if cmd, ok := c.cmds[name]; ok {
+		return cmd.level
+	}
+	return levelEveryone
+}
+
+func cmdPermitLevel(ch *channel, u *User, data string) string {
+	v := split(data, 2)
+	name := strings.TrimPrefix(v[0], "!")
+	if name == "" {
+		return "Usage: !permit-level <command> [" + strings.Join(levelNames, "|") + "|default]"
+	}
+
+	ch.cmds.Lock()
+	defer ch.cmds.Unlock()
+
+	name = ch.cmds.resolve(name)
+	cmd, ok := ch.cmds.cmds[name]
+	if !ok {
+		return fmt.Sprintf("!%s isn't a command", name)
+	}
+
+	arg := strings.ToLower(strings.TrimSpace(v[1]))
+	switch arg {
+	case "":
+		return fmt.Sprintf("!%s needs level %s", name, ch.cmds.level(name))
+	case "default":
+		if err := ch.cmds.levelStore.Remove(name); err != nil {
+			return errSaving(err)
+		}
+		delete(ch.cmds.levels, name)
+		return fmt.Sprintf("!%s is back to level %s", name, cmd.level)
+	}
+
+	l, ok := parseLevel(arg)
+	if !ok {
+		return fmt.Sprintf("Unknown level %q. Levels: %s", arg, strings.Join(levelNames, " "))
+	}
+	// Stop mods locking themselves out, or granting a level above their own
+	if l > u.Level || ch.cmds.level(name) > u.Level {
+		return "I'm afraid you can't set a level above your own"
+	}
+
+	if err := ch.cmds.levelStore.Add(name, l.String()); err != nil {
+		return errSaving(err)
+	}
+	ch.cmds.levels[name] = l
+	return fmt.Sprintf("!%s now needs level %s", name, l)
+}
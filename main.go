@@ -3,34 +3,58 @@ Uptime
 Game (+IGN rating, if available)
 Quotes (quote/addquote)
 Custom commands (add/remove)
-Welcome subs
+Welcome subs, resubs, gift subs and raids
 */
 
 package main
 
 import (
-	"bufio"
-	"fmt"
 	"log"
 	"math/rand"
-	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
 var (
-	CHANNEL       = os.Getenv("BOT_CHANNEL")
-	USER          = os.Getenv("BOT_USER")
-	PASSWORD      = os.Getenv("BOT_PASSWORD")
-	MASHAPE_KEY   = os.Getenv("BOT_MASHAPE_KEY")
-	CLIENT_ID     = os.Getenv("BOT_CLIENT_ID")
-	CLIENT_SECRET = os.Getenv("BOT_CLIENT_SECRET")
-	GITHUB_SECRET = os.Getenv("BOT_GITHUB_SECRET")
-	CURRENCY_NAME = os.Getenv("BOT_CURRENCY_NAME")
+	CHANNELS       = splitList(os.Getenv("BOT_CHANNEL"))
+	USER           = os.Getenv("BOT_USER")
+	PASSWORD       = os.Getenv("BOT_PASSWORD")
+	RAPIDAPI_KEY   = getenv("BOT_RAPIDAPI_KEY", os.Getenv("BOT_MASHAPE_KEY"))
+	CLIENT_ID      = os.Getenv("BOT_CLIENT_ID")
+	CLIENT_SECRET  = os.Getenv("BOT_CLIENT_SECRET")
+	GITHUB_SECRET  = os.Getenv("BOT_GITHUB_SECRET")
+	CURRENCY_NAME  = os.Getenv("BOT_CURRENCY_NAME")
+	OWNER          = os.Getenv("BOT_OWNER")
+	HELIX_URL      = getenv("BOT_HELIX_URL", "https://api.twitch.tv/helix")
+	OAUTH_URL      = getenv("BOT_OAUTH_URL", "https://id.twitch.tv/oauth2")
+	REDIRECT_URL   = os.Getenv("BOT_REDIRECT_URL")
+	IGDB_URL       = getenv("BOT_IGDB_URL", "https://api.igdb.com/v4")
+	OPENCRITIC_URL = getenv("BOT_OPENCRITIC_URL", "https://opencritic-api.p.rapidapi.com")
+	IRC_HOST       = os.Getenv("BOT_IRC_HOST")
+	IRC_PORT       = os.Getenv("BOT_IRC_PORT")
+	IRC_PLAINTEXT  = os.Getenv("BOT_IRC_PLAINTEXT") == "1"
+	IRC_CA_FILE    = os.Getenv("BOT_IRC_CA_FILE")
+	STORAGE        = getenv("BOT_STORAGE", storageJSON)
 )
 
-const IRCIdleConnectionTimeout = 5 * time.Minute
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func splitList(s string) []string {
+	r := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			r = append(r, v)
+		}
+	}
+	return r
+}
 
 func must(err error) {
 	if err != nil {
@@ -43,42 +67,24 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		must(migrate())
+		return
+	}
+
 	log.Printf("PASSWORD=%v\n", PASSWORD)
-	log.Printf("MASHAPE_KEY=%v\n", MASHAPE_KEY)
+	log.Printf("RAPIDAPI_KEY=%v\n", RAPIDAPI_KEY)
 	log.Printf("CLIENT_ID=%v\n", CLIENT_ID)
 	log.Printf("CLIENT_SECRET=%v\n", CLIENT_SECRET)
 	log.Printf("GITHUB_SECRET=%v\n", GITHUB_SECRET)
 
 	log.Print("Let's do this thing!\n")
-	c, err := net.Dial("tcp", "irc.chat.twitch.tv:6667")
-	must(err)
-
-	in := bufio.NewReader(c)
-	out := make(chan string, 1000)
-
-	fmt.Fprintf(c, "CAP REQ :twitch.tv/tags\r\n")
-	fmt.Fprintf(c, "PASS oauth:%s\r\n", PASSWORD)
-	fmt.Fprintf(c, "USER %s\r\n", USER)
-	fmt.Fprintf(c, "NICK %s\r\n", USER)
-	fmt.Fprintf(c, "JOIN #%s\r\n", CHANNEL)
-
-	go func() {
-		for m := range out {
-			//log.Printf("[OUT] %s", m)
-			fmt.Fprint(c, m)
-			time.Sleep(time.Second)
-		}
-	}()
-
-	go func() {
-		for {
-			c.SetReadDeadline(time.Now().Add(IRCIdleConnectionTimeout))
-			line, err := in.ReadSlice('\n')
-			must(err)
-			//log.Printf("[IN]  %s", line)
-			go handle(out, parse(line))
-		}
-	}()
+	c := &ircClient{out: newOutbox()}
+	go c.run()
+	go pollStreams()
+	go runTimers(c.out)
+	go runWatchEarnings()
+	go runFlushUses()
 
 	http.ListenAndServe(":4200", nil)
 }
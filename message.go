@@ -2,115 +2,209 @@ package main
 
 import (
 	"bytes"
-	"log"
+	"errors"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type message struct {
+	Prefix      prefix
+	Tags        map[string]string
+	ID          string
 	DisplayName string
+	Color       string
+	Badges      map[string]string
+	BadgeInfo   map[string]string
 	Mod         bool
 	Sub         bool
+	FirstMsg    bool
+	Bits        int
+	Emotes      []emote
+	SentAt      time.Time
+	MsgID       string
+	ReplyParent *replyParent
 	Command     string
 	RoomID      string
 	UserID      string
 	Args        []string
 }
 
-func parse(line []byte) *message {
-	if line[len(line)-2] != '\r' || line[len(line)-1] != '\n' {
-		log.Print("INVALID LINE")
-		return nil
+type prefix struct {
+	Nick string
+	User string
+	Host string
+}
+
+type emote struct {
+	ID    string
+	Start int
+	End   int
+}
+
+type replyParent struct {
+	MsgID       string
+	UserID      string
+	UserLogin   string
+	DisplayName string
+	Body        string
+}
+
+func (m *message) HasBadge(name string) bool {
+	_, ok := m.Badges[name]
+	return ok
+}
+
+func (m *message) IsBroadcaster() bool { return m.HasBadge("broadcaster") }
+func (m *message) IsVIP() bool         { return m.HasBadge("vip") }
+func (m *message) IsFounder() bool     { return m.HasBadge("founder") }
+
+// SubMonths is the number of months subscribed, taken from badge-info since the
+// subscriber badge only records the badge tier.
+func (m *message) SubMonths() int {
+	v, ok := m.BadgeInfo["subscriber"]
+	if !ok {
+		v = m.BadgeInfo["founder"]
 	}
+	n, _ := strconv.Atoi(v)
+	return n
+}
 
-	line = line[:len(line)-2]
-	m := &message{}
-	i := 0
-	b := bytes.NewBuffer(nil)
+// EmoteCount counts emote uses, not distinct emotes
+func (m *message) EmoteCount() int {
+	return len(m.Emotes)
+}
+
+// parse reads a single line from the server. It never panics on malformed
+// input, since one bad line shouldn't take down every channel.
+func parse(line []byte) (*message, error) {
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("line does not end in CRLF")
+	}
+	s := string(line[:len(line)-2])
+	if strings.ContainsAny(s, "\x00\r\n") {
+		return nil, errors.New("NUL, CR or LF inside line")
+	}
+	m := &message{Tags: map[string]string{}}
 
 	// parse tags
-	if line[i] == '@' {
-		k, v := "", ""
-		for i++; line[i] != ' '; i++ {
-			switch line[i] {
-			case ';':
-				v = b.String()
-				b.Reset()
-				handleTag(m, k, v)
-			case '=':
-				k = b.String()
-				b.Reset()
-			case '\\':
-				i++
-				switch line[i] {
-				case ':':
-					b.WriteByte(';')
-				case 's':
-					b.WriteByte(' ')
-				case '\\':
-					b.WriteByte('\\')
-				case 'r':
-					b.WriteByte('\r')
-				case 'n':
-					b.WriteByte('\n')
-				}
-			default:
-				b.WriteByte(line[i])
+	if strings.HasPrefix(s, "@") {
+		i := strings.IndexByte(s, ' ')
+		if i < 0 {
+			return nil, errors.New("tags without a command")
+		}
+		for _, tag := range strings.Split(s[1:i], ";") {
+			k, v := tag, ""
+			if j := strings.IndexByte(tag, '='); j >= 0 {
+				k, v = tag[:j], unescapeTag(tag[j+1:])
+			}
+			if k == "" {
+				continue
 			}
+			handleTag(m, k, v)
 		}
-		v = b.String()
-		b.Reset()
-		handleTag(m, k, v)
-		i++
+		s = strings.TrimLeft(s[i+1:], " ")
 	}
 
 	// parse prefix
-	if line[i] == ':' {
-		for {
-			i++
-			if line[i] == ' ' {
-				break
-			}
-			b.WriteByte(line[i])
+	if strings.HasPrefix(s, ":") {
+		i := strings.IndexByte(s, ' ')
+		if i < 0 {
+			return nil, errors.New("prefix without a command")
 		}
-		// prefix := b.String()
-		b.Reset()
-		i++
+		m.Prefix = parsePrefix(s[1:i])
+		if m.Prefix.Nick == "" && m.Prefix.Host == "" || m.Prefix.Nick == "" && strings.ContainsAny(s[1:i], "!@") {
+			return nil, errors.New("prefix without a nick or server name")
+		}
+		s = strings.TrimLeft(s[i+1:], " ")
 	}
 
 	// parse command
-	for ; line[i] != ' '; i++ {
-		b.WriteByte(line[i])
+	command := s
+	s = ""
+	if i := strings.IndexByte(command, ' '); i >= 0 {
+		command, s = command[:i], strings.TrimLeft(command[i+1:], " ")
+	}
+	if command == "" {
+		return nil, errors.New("missing command")
 	}
-	m.Command = strings.ToUpper(b.String())
-	b.Reset()
-	i++
+	m.Command = strings.ToUpper(command)
 
 	// parse args
-	for i < len(line) && line[i] != ':' {
-		for ; i < len(line) && line[i] != ' '; i++ {
-			b.WriteByte(line[i])
+	for s != "" {
+		if s[0] == ':' {
+			m.Args = append(m.Args, s[1:])
+			break
 		}
-		m.Args = append(m.Args, b.String())
-		b.Reset()
-		i++
+		i := strings.IndexByte(s, ' ')
+		if i < 0 {
+			m.Args = append(m.Args, s)
+			break
+		}
+		m.Args = append(m.Args, s[:i])
+		s = strings.TrimLeft(s[i+1:], " ")
 	}
-	if i < len(line) && line[i] == ':' {
-		i++
-		b.Write(line[i:])
-		m.Args = append(m.Args, b.String())
+
+	return m, nil
+}
+
+// parsePrefix splits nick!user@host. Server prefixes are just a host.
+func parsePrefix(p string) prefix {
+	var r prefix
+	if i := strings.IndexByte(p, '@'); i >= 0 {
+		p, r.Host = p[:i], p[i+1:]
+	}
+	if i := strings.IndexByte(p, '!'); i >= 0 {
+		p, r.User = p[:i], p[i+1:]
 	}
+	if r.User == "" && r.Host == "" && strings.ContainsAny(p, ".") {
+		r.Host = p
+	} else {
+		r.Nick = p
+	}
+	return r
+}
 
-	return m
+func unescapeTag(v string) string {
+	if !strings.Contains(v, "\\") {
+		return v
+	}
+	b := bytes.NewBuffer(nil)
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' {
+			b.WriteByte(v[i])
+			continue
+		}
+		i++
+		if i >= len(v) {
+			break
+		}
+		switch v[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(v[i])
+		}
+	}
+	return b.String()
 }
 
 func handleTag(m *message, k string, v string) {
-	if k == "" {
-		k = v
-		v = ""
-	}
+	m.Tags[k] = v
 	switch k {
+	case "id":
+		m.ID = v
 	case "display-name":
 		m.DisplayName = v
+	case "color":
+		m.Color = v
 	case "user-id":
 		m.UserID = v
 	case "room-id":
@@ -119,5 +213,181 @@ func handleTag(m *message, k string, v string) {
 		m.Mod = v == "1"
 	case "subscriber":
 		m.Sub = v == "1"
+	case "first-msg":
+		m.FirstMsg = v == "1"
+	case "badges":
+		m.Badges = parseBadges(v)
+	case "badge-info":
+		m.BadgeInfo = parseBadges(v)
+	case "bits":
+		m.Bits, _ = strconv.Atoi(v)
+	case "emotes":
+		m.Emotes = parseEmotes(v)
+	case "tmi-sent-ts":
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+			m.SentAt = time.Unix(0, ms*int64(time.Millisecond))
+		}
+	case "msg-id":
+		m.MsgID = v
+	case "reply-parent-msg-id", "reply-parent-user-id", "reply-parent-user-login", "reply-parent-display-name", "reply-parent-msg-body":
+		if m.ReplyParent == nil {
+			m.ReplyParent = &replyParent{}
+		}
+		switch k {
+		case "reply-parent-msg-id":
+			m.ReplyParent.MsgID = v
+		case "reply-parent-user-id":
+			m.ReplyParent.UserID = v
+		case "reply-parent-user-login":
+			m.ReplyParent.UserLogin = v
+		case "reply-parent-display-name":
+			m.ReplyParent.DisplayName = v
+		case "reply-parent-msg-body":
+			m.ReplyParent.Body = v
+		}
+	}
+}
+
+// parseBadges parses "moderator/1,subscriber/12" into name -> version
+func parseBadges(v string) map[string]string {
+	badges := map[string]string{}
+	for _, b := range strings.Split(v, ",") {
+		if b == "" {
+			continue
+		}
+		p := strings.SplitN(b, "/", 2)
+		if len(p) == 1 {
+			p = append(p, "")
+		}
+		badges[p[0]] = p[1]
+	}
+	return badges
+}
+
+// parseEmotes parses "25:0-4,12-16/1902:6-10", one entry per use
+func parseEmotes(v string) []emote {
+	emotes := []emote{}
+	for _, e := range strings.Split(v, "/") {
+		p := strings.SplitN(e, ":", 2)
+		if len(p) != 2 {
+			continue
+		}
+		for _, r := range strings.Split(p[1], ",") {
+			se := strings.SplitN(r, "-", 2)
+			if len(se) != 2 {
+				continue
+			}
+			start, err1 := strconv.Atoi(se[0])
+			end, err2 := strconv.Atoi(se[1])
+			if err1 == nil && err2 == nil {
+				emotes = append(emotes, emote{p[0], start, end})
+			}
+		}
+	}
+	return emotes
+}
+
+// maxMessageLength is Twitch's limit on the text of a single PRIVMSG
+const maxMessageLength = 500
+
+// encode is the inverse of parse, producing a CRLF terminated line. CR and LF
+// are replaced in every argument so user supplied text can't inject commands.
+func (m *message) encode() string {
+	b := bytes.NewBuffer(nil)
+
+	if len(m.Tags) > 0 {
+		keys := make([]string, 0, len(m.Tags))
+		for k := range m.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteByte('@')
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteByte(';')
+			}
+			b.WriteString(k)
+			if v := m.Tags[k]; v != "" {
+				b.WriteByte('=')
+				b.WriteString(escapeTag(v))
+			}
+		}
+		b.WriteByte(' ')
+	}
+
+	if p := m.Prefix; p.Nick != "" || p.Host != "" {
+		b.WriteByte(':')
+		if p.Nick != "" {
+			b.WriteString(sanitize(p.Nick))
+			if p.User != "" {
+				b.WriteByte('!')
+				b.WriteString(sanitize(p.User))
+			}
+			if p.Host != "" {
+				b.WriteByte('@')
+			}
+		}
+		b.WriteString(sanitize(p.Host))
+		b.WriteByte(' ')
+	}
+
+	b.WriteString(m.Command)
+	for i, arg := range m.Args {
+		arg = sanitize(arg)
+		b.WriteByte(' ')
+		if i == len(m.Args)-1 && (arg == "" || arg[0] == ':' || strings.Contains(arg, " ")) {
+			b.WriteByte(':')
+		}
+		b.WriteString(arg)
+	}
+
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+func escapeTag(v string) string {
+	return strings.NewReplacer(
+		"\\", "\\\\",
+		";", "\\:",
+		" ", "\\s",
+		"\r", "\\r",
+		"\n", "\\n",
+	).Replace(v)
+}
+
+func sanitize(v string) string {
+	return strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ", "\x00", "").Replace(v)
+}
+
+// splitText breaks text into chunks of at most max characters, preferring to
+// break on spaces. Words longer than max are cut.
+func splitText(text string, max int) []string {
+	chunks := []string{}
+	current := []rune{}
+	for _, word := range strings.Fields(text) {
+		w := []rune(word)
+		for len(w) > max {
+			if len(current) > 0 {
+				chunks = append(chunks, string(current))
+				current = current[:0]
+			}
+			chunks = append(chunks, string(w[:max]))
+			w = w[max:]
+		}
+		if len(w) == 0 {
+			continue
+		}
+		if len(current) > 0 && len(current)+1+len(w) > max {
+			chunks = append(chunks, string(current))
+			current = current[:0]
+		}
+		if len(current) > 0 {
+			current = append(current, ' ')
+		}
+		current = append(current, w...)
+	}
+	if len(current) > 0 {
+		chunks = append(chunks, string(current))
 	}
+	return chunks
 }
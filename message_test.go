@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Lines captured from Twitch chat, with names and IDs changed
+var realLines = []string{
+	":tmi.twitch.tv 001 kaetbot :Welcome, GLHF!\r\n",
+	"PING :tmi.twitch.tv\r\n",
+	":tmi.twitch.tv CAP * ACK :twitch.tv/tags twitch.tv/commands\r\n",
+	":kaetbot!kaetbot@kaetbot.tmi.twitch.tv JOIN #kate\r\n",
+	":kaetbot.tmi.twitch.tv 353 kaetbot = #kate :kaetbot\r\n",
+	"@emote-only=0;followers-only=-1;r9k=0;room-id=12345678;slow=0;subs-only=0 :tmi.twitch.tv ROOMSTATE #kate\r\n",
+	"@badge-info=;badges=moderator/1;color=#1E90FF;display-name=KaetBot;emote-sets=0,300374282;mod=1;subscriber=0;user-type=mod :tmi.twitch.tv USERSTATE #kate\r\n",
+	"@badge-info=subscriber/14;badges=broadcaster/1,subscriber/12;client-nonce=4b1d;color=#FF69B4;display-name=Kate;emotes=25:0-4,12-16/1902:6-10;first-msg=0;flags=;id=b34ccfc7-4977-403a-8a94-33c6bac34fb8;mod=0;returning-chatter=0;room-id=12345678;subscriber=1;tmi-sent-ts=1642696567751;turbo=0;user-id=12345678;user-type= :kate!kate@kate.tmi.twitch.tv PRIVMSG #kate :Kappa Keepo Kappa\r\n",
+	"@badge-info=;badges=bits/100;bits=100;color=;display-name=Viewer;emotes=;id=7eb848c9-1060-4e5e-9f4c-612877982e79;mod=0;room-id=12345678;subscriber=0;tmi-sent-ts=1642696567751;user-id=87654321;user-type= :viewer!viewer@viewer.tmi.twitch.tv PRIVMSG #kate :cheer100 hype!\r\n",
+	"@badge-info=;badges=;color=;display-name=Viewer;emotes=;id=1a2b;mod=0;reply-parent-display-name=Kate;reply-parent-msg-body=did\\syou\\ssee\\sthat?;reply-parent-msg-id=b34ccfc7-4977-403a-8a94-33c6bac34fb8;reply-parent-user-id=12345678;reply-parent-user-login=kate;room-id=12345678;subscriber=0;tmi-sent-ts=1642696567751;user-id=87654321;user-type= :viewer!viewer@viewer.tmi.twitch.tv PRIVMSG #kate :@Kate yes!\r\n",
+	"@badge-info=subscriber/1;badges=subscriber/0;color=;display-name=NewSub;emotes=;id=db25007f;login=newsub;mod=0;msg-id=sub;msg-param-cumulative-months=1;msg-param-sub-plan=1000;msg-param-sub-plan-name=Channel\\sSubscription\\s(kate);room-id=12345678;subscriber=1;system-msg=NewSub\\ssubscribed\\sat\\sTier\\s1.;tmi-sent-ts=1642696567751;user-id=11111111;user-type= :tmi.twitch.tv USERNOTICE #kate\r\n",
+	"@msg-id=raid;msg-param-displayName=Raider;msg-param-login=raider;msg-param-viewerCount=42;room-id=12345678;system-msg=42\\sraiders\\sfrom\\sRaider\\shave\\sjoined!;tmi-sent-ts=1642696567751 :tmi.twitch.tv USERNOTICE #kate\r\n",
+	"@ban-duration=600;room-id=12345678;target-user-id=87654321;tmi-sent-ts=1642696567751 :tmi.twitch.tv CLEARCHAT #kate :viewer\r\n",
+	"@msg-id=msg_channel_suspended :tmi.twitch.tv NOTICE #kate :This channel does not exist or has been suspended.\r\n",
+	":tmi.twitch.tv RECONNECT\r\n",
+	"@badges=;color=;display-name=Viewer;emotes=;message-id=3;thread-id=11111111_22222222;turbo=0;user-id=87654321;user-type= :viewer!viewer@viewer.tmi.twitch.tv WHISPER kaetbot :hi there\r\n",
+}
+
+func TestParseRealLines(t *testing.T) {
+	for _, line := range realLines {
+		m, err := parse([]byte(line))
+		if err != nil {
+			t.Errorf("parse(%q): %v", line, err)
+			continue
+		}
+		m2, err := parse([]byte(m.encode()))
+		if err != nil {
+			t.Errorf("parse(encode(%q)): %v", line, err)
+			continue
+		}
+		if !reflect.DeepEqual(m, m2) {
+			t.Errorf("round trip of %q\n got %+v\nwant %+v", line, m2, m)
+		}
+	}
+}
+
+func TestParseFields(t *testing.T) {
+	m, err := parse([]byte(realLines[9]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Command != "PRIVMSG" || !reflect.DeepEqual(m.Args, []string{"#kate", "@Kate yes!"}) {
+		t.Errorf("command %q args %q", m.Command, m.Args)
+	}
+	if m.Prefix != (prefix{"viewer", "viewer", "viewer.tmi.twitch.tv"}) {
+		t.Errorf("prefix %+v", m.Prefix)
+	}
+	if m.ReplyParent == nil || m.ReplyParent.Body != "did you see that?" || m.ReplyParent.UserLogin != "kate" {
+		t.Errorf("reply parent %+v", m.ReplyParent)
+	}
+
+	m, err = parse([]byte(realLines[7]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.IsBroadcaster() || m.SubMonths() != 14 || m.EmoteCount() != 3 || m.RoomID != "12345678" {
+		t.Errorf("broadcaster %v months %d emotes %d room %q", m.IsBroadcaster(), m.SubMonths(), m.EmoteCount(), m.RoomID)
+	}
+}
+
+// FuzzParse checks parse never panics, and that whatever it accepts encodes
+// to a line that parses back to the same message.
+func FuzzParse(f *testing.F) {
+	for _, line := range realLines {
+		f.Add([]byte(line))
+	}
+	f.Fuzz(func(t *testing.T, line []byte) {
+		m, err := parse(line)
+		if err != nil {
+			return
+		}
+		enc := m.encode()
+		m2, err := parse([]byte(enc))
+		if err != nil {
+			t.Fatalf("parse(%q) failed on encode of %q: %v", enc, line, err)
+		}
+		if enc2 := m2.encode(); enc2 != enc {
+			t.Fatalf("encode isn't stable for %q: %q then %q", line, enc, enc2)
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// migrate copies the JSON stores (quotes, counters, balances, commands and
+// the rest) into bbolt. Run it with the bot stopped:
+//
+//	BOT_STORAGE=bolt kaet migrate
+//
+// Each JSON file is renamed to .json.migrated once copied, so it stays around
+// as a backup but isn't picked up again.
+func migrate() error {
+	if STORAGE != storageBolt {
+		return fmt.Errorf("BOT_STORAGE is %q, set it to %s to migrate", STORAGE, storageBolt)
+	}
+
+	paths, err := filepath.Glob(filepath.Join("channels", "*", "*.json"))
+	if err != nil {
+		return err
+	}
+	// Stores from before multi-channel support, and the shared ones
+	legacy, err := filepath.Glob("*.json")
+	if err != nil {
+		return err
+	}
+	paths = append(paths, legacy...)
+
+	for _, path := range paths {
+		s, err := migrateStore(strings.TrimSuffix(path, ".json"))
+		if err != nil {
+			return err
+		}
+		s.Close()
+	}
+	log.Printf("Migrated %d stores to %s", len(paths), STORAGE)
+	return nil
+}
+
+// migrateStore copies name.json into bbolt, returning the new store
+func migrateStore(name string) (*boltStore, error) {
+	src := newJSONStore(name + ".json")
+	dst := newBoltStore(name + storeExts[storageBolt])
+	if len(dst.Keys()) > 0 {
+		dst.Close()
+		return nil, fmt.Errorf("%s already has data in %s, not overwriting it", name, storageBolt)
+	}
+
+	tx := dst.Begin()
+	defer tx.Rollback()
+	for k, v := range src.data {
+		if err := tx.Put(k, v); err != nil {
+			dst.Close()
+			return nil, fmt.Errorf("migrating %s: %v", name, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		dst.Close()
+		return nil, fmt.Errorf("migrating %s: %v", name, err)
+	}
+	log.Printf("Migrated %d keys from %s.json", len(src.data), name)
+	if err := os.Rename(name+".json", name+".json.migrated"); err != nil {
+		dst.Close()
+		return nil, err
+	}
+	return dst, nil
+}
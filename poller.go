@@ -0,0 +1,165 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const streamPollInterval = time.Minute
+
+// streamState is the last known state of a channel, refreshed by the poller
+// so commands don't each have to hit the API.
+type streamState struct {
+	Live      bool
+	StartedAt time.Time
+	Game      string
+	Title     string
+	Viewers   int
+	Updated   time.Time
+}
+
+type eventKind int
+
+const (
+	eventLive eventKind = iota
+	eventOffline
+	eventGameChange
+)
+
+func (k eventKind) String() string {
+	return [...]string{"live", "offline", "game change"}[k]
+}
+
+type streamEvent struct {
+	Kind    eventKind
+	Channel *channel
+	Old     streamState
+	New     streamState
+}
+
+var subscribers = struct {
+	sync.RWMutex
+	fns []func(streamEvent)
+}{}
+
+// subscribe registers fn to be called, in its own goroutine, for every event
+func subscribe(fn func(streamEvent)) {
+	subscribers.Lock()
+	defer subscribers.Unlock()
+	subscribers.fns = append(subscribers.fns, fn)
+}
+
+func publish(e streamEvent) {
+	log.Printf("Stream event in %s: %s", e.Channel.Name, e.Kind)
+	subscribers.RLock()
+	defer subscribers.RUnlock()
+	for _, fn := range subscribers.fns {
+		go fn(e)
+	}
+}
+
+// Stream returns the cached stream state
+func (ch *channel) Stream() streamState {
+	ch.streamLock.RLock()
+	defer ch.streamLock.RUnlock()
+	return ch.stream
+}
+
+func (ch *channel) setStream(s streamState) {
+	ch.streamLock.Lock()
+	old := ch.stream
+	ch.stream = s
+	ch.streamLock.Unlock()
+
+	// The first poll only establishes the state, it isn't a change
+	if old.Updated.IsZero() {
+		return
+	}
+	if s.Live && !old.Live {
+		publish(streamEvent{eventLive, ch, old, s})
+	}
+	if !s.Live && old.Live {
+		publish(streamEvent{eventOffline, ch, old, s})
+	}
+	if s.Game != old.Game && s.Game != "" {
+		publish(streamEvent{eventGameChange, ch, old, s})
+	}
+}
+
+func pollStreams() {
+	for {
+		channels.Lock()
+		list := make([]*channel, 0, len(channels.m))
+		for _, ch := range channels.m {
+			list = append(list, ch)
+		}
+		channels.Unlock()
+
+		// Helix takes up to 100 IDs per request
+		for len(list) > 0 {
+			n := len(list)
+			if n > 100 {
+				n = 100
+			}
+			if err := pollChannels(list[:n]); err != nil {
+				log.Printf("pollStreams=%v", err)
+			}
+			list = list[n:]
+		}
+
+		time.Sleep(streamPollInterval)
+	}
+}
+
+func pollChannels(list []*channel) error {
+	ids := url.Values{}
+	streamIDs := url.Values{}
+	for _, ch := range list {
+		ids.Add("broadcaster_id", ch.RoomID)
+		streamIDs.Add("user_id", ch.RoomID)
+	}
+
+	var streams struct {
+		Data []struct {
+			UserID      string    `json:"user_id"`
+			StartedAt   time.Time `json:"started_at"`
+			ViewerCount int       `json:"viewer_count"`
+		} `json:"data"`
+	}
+	if err := helix.get(&streams, "streams", streamIDs); err != nil {
+		return err
+	}
+
+	var info struct {
+		Data []struct {
+			BroadcasterID string `json:"broadcaster_id"`
+			GameName      string `json:"game_name"`
+			Title         string `json:"title"`
+		} `json:"data"`
+	}
+	if err := helix.get(&info, "channels", ids); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	states := map[string]*streamState{}
+	for _, ch := range list {
+		states[ch.RoomID] = &streamState{Updated: now}
+	}
+	for _, s := range streams.Data {
+		if st, ok := states[s.UserID]; ok {
+			st.Live, st.StartedAt, st.Viewers = true, s.StartedAt, s.ViewerCount
+		}
+	}
+	for _, c := range info.Data {
+		if st, ok := states[c.BroadcasterID]; ok {
+			st.Game, st.Title = c.GameName, c.Title
+		}
+	}
+	for _, ch := range list {
+		ch.setStream(*states[ch.RoomID])
+	}
+	return nil
+}
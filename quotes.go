@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// quote is what's saved in quotes.json for each quote. Removed quotes are
+// kept, marked deleted, so the numbers of later quotes don't change.
+type quote struct {
+	Text    string    `json:"text"`
+	Game    string    `json:"game,omitempty"`
+	Time    time.Time `json:"time"`
+	AdderID string    `json:"adder_id,omitempty"`
+	Person  string    `json:"person,omitempty"`
+	Deleted bool      `json:"deleted,omitempty"`
+}
+
+// Quotes used to be saved as "text [Playing game - RFC822 time]"
+var legacyQuote = regexp.MustCompile(`(?s)^(.*) \[Playing (.*) - (\d\d \w{3} \d\d \d\d:\d\d \w+)\]$`)
+
+// quoteLocation is the streamer's timezone, used to show when quotes were said
+func quoteLocation() *time.Location {
+	if l, err := time.LoadLocation("America/Vancouver"); err == nil {
+		return l
+	}
+	return time.Local
+}
+
+// upgradeQuotes turns any quotes saved as plain strings into records, all in
+// one go so a failure leaves the old strings untouched.
+func upgradeQuotes(s Storage) Storage {
+	keys := s.Keys()
+	tx := s.Begin()
+	defer tx.Rollback()
+	upgraded := 0
+	for _, k := range keys {
+		var text string
+		if !tx.Load(k, &text) {
+			continue
+		}
+		must(tx.Put(k, parseLegacyQuote(text)))
+		upgraded++
+	}
+	must(tx.Commit())
+	if upgraded > 0 {
+		log.Printf("Upgraded %d quotes to records", upgraded)
+	}
+	return s
+}
+
+func parseLegacyQuote(text string) quote {
+	if text == "" {
+		return quote{Deleted: true}
+	}
+	m := legacyQuote.FindStringSubmatch(text)
+	if m == nil {
+		return quote{Text: text}
+	}
+	q := quote{Text: m[1], Game: m[2]}
+	if t, err := time.ParseInLocation(time.RFC822, m[3], quoteLocation()); err == nil {
+		q.Time = t
+	}
+	return q
+}
+
+func (q quote) String() string {
+	s := q.Text
+	if q.Person != "" {
+		s += " - " + q.Person
+	}
+	if q.Game != "" || !q.Time.IsZero() {
+		s += fmt.Sprintf(" [Playing %s - %s]", q.Game, q.Time.In(quoteLocation()).Format(time.RFC822))
+	}
+	return s
+}
+
+// quoteFilter matches quotes against "game:<name>", "by:<person>" or a search
+// of the text. Deleted quotes never match.
+func quoteFilter(query string) func(quote) bool {
+	query = strings.ToLower(strings.TrimSpace(query))
+	switch {
+	case strings.HasPrefix(query, "game:"):
+		game := strings.TrimSpace(query[len("game:"):])
+		return func(q quote) bool {
+			return !q.Deleted && strings.Contains(strings.ToLower(q.Game), game)
+		}
+	case strings.HasPrefix(query, "by:"):
+		person := strings.TrimPrefix(strings.TrimSpace(query[len("by:"):]), "@")
+		return func(q quote) bool {
+			return !q.Deleted && strings.Contains(strings.ToLower(q.Person), person)
+		}
+	}
+	return func(q quote) bool {
+		return !q.Deleted && strings.Contains(strings.ToLower(q.Text), query)
+	}
+}
+
+// findQuotes returns the numbers of the quotes that match, in order
+func findQuotes(ch *channel, match func(quote) bool) []int {
+	nums := []int{}
+	for _, k := range ch.quotes.Keys() {
+		var q quote
+		n, err := strconv.Atoi(k)
+		if err == nil && ch.quotes.Load(k, &q) && match(q) {
+			nums = append(nums, n)
+		}
+	}
+	return nums
+}
+
+func showQuote(ch *channel, n int) string {
+	var q quote
+	if !ch.quotes.Load(strconv.Itoa(n), &q) || q.Deleted {
+		return "Not found"
+	}
+	return fmt.Sprintf("%s #%d", q, n)
+}
+
+func randomQuote(ch *channel, query string) string {
+	nums := findQuotes(ch, quoteFilter(query))
+	if len(nums) == 0 {
+		return "None Found"
+	}
+	return showQuote(ch, nums[rand.Intn(len(nums))])
+}
+
+func parseQuoteNumber(s string) (int, bool) {
+	n, err := strconv.Atoi(strings.TrimPrefix(s, "#"))
+	return n, err == nil
+}
+
+func cmdGetQuote(ch *channel, _ *User, query string) string {
+	if strings.HasPrefix(query, "#") {
+		if n, ok := parseQuoteNumber(query); ok {
+			return showQuote(ch, n)
+		}
+		return "Not found"
+	}
+	return randomQuote(ch, query)
+}
+
+func cmdLastQuote(ch *channel, _ *User, _ string) string {
+	nums := findQuotes(ch, quoteFilter(""))
+	if len(nums) == 0 {
+		return "None Found"
+	}
+	last := nums[0]
+	for _, n := range nums {
+		if n > last {
+			last = n
+		}
+	}
+	return showQuote(ch, last)
+}
+
+func cmdQuoteCount(ch *channel, _ *User, query string) string {
+	n := len(findQuotes(ch, quoteFilter(query)))
+	if strings.TrimSpace(query) == "" {
+		return fmt.Sprintf("There are %d quotes", n)
+	}
+	return fmt.Sprintf("%d quotes match %q", n, strings.TrimSpace(query))
+}
+
+func cmdAddQuote(ch *channel, u *User, data string) string {
+	// Game is left empty until the first poll rather than saving a placeholder
+	q := quote{Text: strings.TrimSpace(data), Game: ch.Stream().Game, Time: time.Now().Round(time.Second), AdderID: u.ID}
+	if strings.HasPrefix(strings.ToLower(q.Text), "by:") {
+		v := strings.SplitN(q.Text, " ", 2)
+		if len(v) < 2 {
+			return "Usage: !addquote [by:<person>] <quote>"
+		}
+		q.Person = strings.TrimPrefix(v[0][len("by:"):], "@")
+		q.Text = strings.TrimSpace(v[1])
+	}
+	if q.Text == "" {
+		return "Usage: !addquote [by:<person>] <quote>"
+	}
+
+	n, err := ch.quotes.Append(q)
+	if err != nil {
+		return errSaving(err)
+	}
+	return "Added quote #" + n
+}
+
+func cmdEditQuote(ch *channel, _ *User, data string) string {
+	v := strings.SplitN(strings.TrimSpace(data), " ", 2)
+	n, ok := parseQuoteNumber(v[0])
+	if !ok || len(v) < 2 || strings.TrimSpace(v[1]) == "" {
+		return "Usage: !editquote <#number> <text|game:<name>|by:<person>>"
+	}
+	change := strings.TrimSpace(v[1])
+
+	key := strconv.Itoa(n)
+	tx := ch.quotes.Begin()
+	defer tx.Rollback()
+	var q quote
+	if !tx.Load(key, &q) || q.Deleted {
+		return "Not found"
+	}
+
+	lower := strings.ToLower(change)
+	switch {
+	case strings.HasPrefix(lower, "game:"):
+		q.Game = strings.TrimSpace(change[len("game:"):])
+	case strings.HasPrefix(lower, "by:"):
+		q.Person = strings.TrimPrefix(strings.TrimSpace(change[len("by:"):]), "@")
+	default:
+		q.Text = change
+	}
+	if err := tx.Put(key, q); err != nil {
+		return errSaving(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return errSaving(err)
+	}
+	return fmt.Sprintf("Updated #%d: %s", n, q)
+}
+
+func cmdRemoveQuote(ch *channel, _ *User, data string) string {
+	n, ok := parseQuoteNumber(strings.TrimSpace(data))
+	if !ok {
+		return "Usage: !removequote <#number>"
+	}
+
+	key := strconv.Itoa(n)
+	tx := ch.quotes.Begin()
+	defer tx.Rollback()
+	var q quote
+	if !tx.Load(key, &q) || q.Deleted {
+		return ""
+	}
+	q.Deleted = true
+	if err := tx.Put(key, q); err != nil {
+		return errSaving(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return errSaving(err)
+	}
+	return fmt.Sprintf("Removed #%d", n)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Twitch chat limits, see https://dev.twitch.tv/docs/irc#rate-limits
+var (
+	chatLimit    = limit{20, 30 * time.Second}
+	modChatLimit = limit{100, 30 * time.Second}
+	joinLimit    = limit{20, 10 * time.Second}
+)
+
+const outboxCapacity = 1000
+
+type limit struct {
+	count int
+	per   time.Duration
+}
+
+// window allows at most count sends in any span of per. It remembers when
+// each recent send happened, since a refilling bucket would let through
+// nearly twice the limit across the boundary of a window.
+type window struct {
+	limit
+	sent []time.Time
+}
+
+func newWindow(l limit) *window {
+	return &window{limit: l}
+}
+
+func (w *window) prune(now time.Time) {
+	i := 0
+	for i < len(w.sent) && now.Sub(w.sent[i]) >= w.per {
+		i++
+	}
+	w.sent = w.sent[i:]
+}
+
+// wait returns how long until n more sends fit in the window
+func (w *window) wait(n int, now time.Time) time.Duration {
+	w.prune(now)
+	// Something bigger than the whole limit goes once the window is empty
+	if n > w.count {
+		n = w.count
+	}
+	excess := len(w.sent) + n - w.count
+	if excess <= 0 {
+		return 0
+	}
+	return w.sent[excess-1].Add(w.per).Sub(now)
+}
+
+func (w *window) take(n int, now time.Time) {
+	for i := 0; i < n; i++ {
+		w.sent = append(w.sent, now)
+	}
+}
+
+// outbox queues lines for the IRC writer. PONGs skip the queue and the rate
+// limits entirely so a burst of chat replies can never time the connection out.
+type outbox struct {
+	urgent chan string
+	queue  chan string
+
+	sync.Mutex
+	mod     map[string]bool
+	chat    *window
+	modChat *window
+	join    *window
+	held    []string // taken from queue, or put back, but not yet written
+}
+
+func newOutbox() *outbox {
+	return &outbox{
+		urgent:  make(chan string, 10),
+		queue:   make(chan string, outboxCapacity),
+		mod:     make(map[string]bool),
+		chat:    newWindow(chatLimit),
+		modChat: newWindow(modChatLimit),
+		join:    newWindow(joinLimit),
+	}
+}
+
+// Say sends text to a channel, split across several messages if it's too long
+func (o *outbox) Say(channel, text string) {
+	o.send(channel, text, nil)
+}
+
+// Reply sends text to m's channel threaded as a reply to m
+func (o *outbox) Reply(m *message, text string) {
+	tags := map[string]string{}
+	if m.ID != "" {
+		tags["reply-parent-msg-id"] = m.ID
+	}
+	o.send(m.Args[0], text, tags)
+}
+
+func (o *outbox) send(channel, text string, tags map[string]string) {
+	// Prefixing a zero width space stops other bots treating our replies as commands
+	for _, chunk := range splitText(sanitize(text), maxMessageLength-1) {
+		m := &message{Tags: tags, Command: "PRIVMSG", Args: []string{channel, "\u200B" + chunk}}
+		o.Send(m.encode())
+	}
+}
+
+func (o *outbox) Send(line string) {
+	if strings.HasPrefix(line, "PONG ") {
+		o.urgent <- line
+		return
+	}
+	o.queue <- line
+}
+
+// SetMod records whether the bot is a moderator (or the broadcaster) in a
+// channel, which raises the chat limit for that channel.
+func (o *outbox) SetMod(channel string, mod bool) {
+	o.Lock()
+	defer o.Unlock()
+	o.mod[strings.ToLower(channel)] = mod
+}
+
+// windows returns the limits a line counts against and how many sends it costs
+func (o *outbox) windows(line string) ([]*window, int) {
+	m, err := parse([]byte(line))
+	if err != nil {
+		return nil, 0
+	}
+	switch m.Command {
+	case "JOIN":
+		if len(m.Args) < 1 {
+			return nil, 0
+		}
+		return []*window{o.join}, strings.Count(m.Args[0], ",") + 1
+	case "PRIVMSG":
+		if len(m.Args) < 2 {
+			return nil, 0
+		}
+		// Messages in channels we moderate only count against the higher limit
+		if o.mod[strings.ToLower(m.Args[0])] {
+			return []*window{o.modChat}, 1
+		}
+		return []*window{o.chat, o.modChat}, 1
+	}
+	return nil, 0
+}
+
+// Join queues JOINs for channels ahead of everything else, replacing any
+// JOINs still held from before a reconnect.
+func (o *outbox) Join(channels []string) {
+	o.Lock()
+	defer o.Unlock()
+	held := make([]string, 0, len(channels)+len(o.held))
+	for _, channel := range channels {
+		join := &message{Command: "JOIN", Args: []string{"#" + channel}}
+		held = append(held, join.encode())
+	}
+	for _, line := range o.held {
+		if !strings.HasPrefix(line, "JOIN ") {
+			held = append(held, line)
+		}
+	}
+	o.held = held
+}
+
+// requeue puts back a line that couldn't be written so it goes first once
+// reconnected. PONGs answer a PING on the old connection, so they're dropped.
+func (o *outbox) requeue(line string) {
+	if strings.HasPrefix(line, "PONG ") {
+		return
+	}
+	o.Lock()
+	defer o.Unlock()
+	o.held = append([]string{line}, o.held...)
+}
+
+// takeHeld returns the first held line if it fits in its limits, counting it
+// against them. Otherwise it returns how long to wait before trying again,
+// or false if nothing is held.
+func (o *outbox) takeHeld(now time.Time) (string, time.Duration, bool) {
+	o.Lock()
+	defer o.Unlock()
+	if len(o.held) == 0 {
+		return "", 0, false
+	}
+
+	line := o.held[0]
+	windows, n := o.windows(line)
+	var wait time.Duration
+	for _, w := range windows {
+		if d := w.wait(n, now); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		return "", wait, true
+	}
+	for _, w := range windows {
+		w.take(n, now)
+	}
+	o.held = o.held[1:]
+	return line, 0, true
+}
+
+// next blocks until a line may be written, or returns false once done is
+// closed. Lines held back by the rate limiter stay held so they survive a
+// reconnect.
+func (o *outbox) next(done chan struct{}) (string, bool) {
+	for {
+		select {
+		case <-done:
+			return "", false
+		case line := <-o.urgent:
+			return line, true
+		default:
+		}
+
+		line, wait, ok := o.takeHeld(time.Now())
+		if ok && wait == 0 {
+			return line, true
+		}
+
+		// Only pull more from the queue once nothing is held
+		queue, timer := o.queue, (<-chan time.Time)(nil)
+		if ok {
+			queue, timer = nil, time.After(wait)
+		}
+		select {
+		case <-done:
+			return "", false
+		case line := <-o.urgent:
+			return line, true
+		case line := <-queue:
+			o.Lock()
+			o.held = append(o.held, line)
+			o.Unlock()
+		case <-timer:
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// simulate sends as fast as w allows for d, returning the send times
+func simulate(w *window, n int, d time.Duration) []time.Time {
+	start := time.Unix(0, 0)
+	now := start
+	sent := []time.Time{}
+	for now.Sub(start) < d {
+		if wait := w.wait(n, now); wait > 0 {
+			now = now.Add(wait)
+			continue
+		}
+		w.take(n, now)
+		for i := 0; i < n; i++ {
+			sent = append(sent, now)
+		}
+		now = now.Add(time.Millisecond)
+	}
+	return sent
+}
+
+func TestWindowNeverExceedsLimit(t *testing.T) {
+	for _, l := range []limit{chatLimit, modChatLimit, joinLimit} {
+		for _, n := range []int{1, 3} {
+			sent := simulate(newWindow(l), n, 5*l.per)
+			for i := range sent {
+				inWindow := 0
+				for j := i; j < len(sent) && sent[j].Sub(sent[i]) < l.per; j++ {
+					inWindow++
+				}
+				if inWindow > l.count {
+					t.Fatalf("%d per %s: %d sends in the window starting %s", l.count, l.per, inWindow, sent[i].Sub(sent[0]))
+				}
+			}
+			// Should still use the whole limit, not some fraction of it
+			if want := 5 * (l.count / n * n); len(sent) < want {
+				t.Errorf("%d per %s in batches of %d: only %d sends, want about %d", l.count, l.per, n, len(sent), want)
+			}
+		}
+	}
+}
+
+func TestReplyThreadsOnMessage(t *testing.T) {
+	o := newOutbox()
+	o.Reply(&message{ID: "abc-123", Command: "PRIVMSG", Args: []string{"#test", "!uptime"}}, "Live for 1h")
+	m, err := parse([]byte(<-o.queue))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Tags["reply-parent-msg-id"] != "abc-123" || m.Args[0] != "#test" {
+		t.Errorf("reply is %+v, want it threaded on abc-123 in #test", m)
+	}
+}
+
+func TestOutboxKeepsLinesAcrossReconnect(t *testing.T) {
+	o := newOutbox()
+	o.Say("#test", "queued while disconnected")
+	o.Join([]string{"test"})
+
+	done := make(chan struct{})
+	line, _ := o.next(done)
+	if !strings.HasPrefix(line, "JOIN #test") {
+		t.Fatalf("first line is %q, want the JOIN", line)
+	}
+	line, _ = o.next(done)
+	if !strings.Contains(line, "queued while disconnected") {
+		t.Fatalf("second line is %q", line)
+	}
+
+	// A failed write puts the line back, and reconnecting joins ahead of it
+	// without repeating a JOIN that never went out
+	o.requeue(line)
+	o.requeue("PONG :tmi.twitch.tv\r\n")
+	o.Join([]string{"test"})
+	o.Join([]string{"test"})
+	if len(o.held) != 2 || !strings.HasPrefix(o.held[0], "JOIN #test") || o.held[1] != line {
+		t.Errorf("held is %q, want the JOIN then the failed line", o.held)
+	}
+}
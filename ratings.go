@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ratingTimeout  = 3 * time.Second
+	ratingTTL      = 7 * 24 * time.Hour
+	noRatingTTL    = 24 * time.Hour
+	providerBudget = 10 * time.Second
+)
+
+// RatingProvider looks up a critic rating for a game. An empty rating with a
+// nil error means the provider doesn't know the game.
+type RatingProvider interface {
+	Name() string
+	Rating(ctx context.Context, game string) (string, error)
+}
+
+// ratingChain asks each provider in turn, returning the first rating found
+type ratingChain []RatingProvider
+
+func (c ratingChain) Name() string {
+	names := []string{}
+	for _, p := range c {
+		names = append(names, p.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+func (c ratingChain) Rating(ctx context.Context, game string) (string, error) {
+	var lastErr error
+	for _, p := range c {
+		r, err := p.Rating(ctx, game)
+		if err != nil {
+			log.Printf("%s rating for %q: %v", p.Name(), game, err)
+			lastErr = err
+			continue
+		}
+		if r != "" {
+			return r, nil
+		}
+	}
+	return "", lastErr
+}
+
+// igdbProvider uses IGDB, which authenticates with the bot's Twitch app token
+type igdbProvider struct {
+	baseURL string
+}
+
+func (p *igdbProvider) Name() string { return "igdb" }
+
+func (p *igdbProvider) Rating(ctx context.Context, game string) (string, error) {
+	token, err := helix.appToken(false)
+	if err != nil {
+		return "", err
+	}
+	query := fmt.Sprintf("search %s; fields name,total_rating; where total_rating != null; limit 5;", strconv.Quote(game))
+	req, err := http.NewRequestWithContext(ctx, "POST", p.baseURL+"/games", strings.NewReader(query))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("Client-ID", CLIENT_ID)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Accept", "application/json")
+
+	var data []struct {
+		Name        string  `json:"name"`
+		TotalRating float64 `json:"total_rating"`
+	}
+	if err := doJSON(req, &data); err != nil {
+		return "", err
+	}
+	for _, g := range data {
+		if strings.EqualFold(g.Name, game) {
+			return fmt.Sprintf("%d/100", int(math.Round(g.TotalRating))), nil
+		}
+	}
+	return "", nil
+}
+
+// openCriticProvider uses the OpenCritic API on RapidAPI
+type openCriticProvider struct {
+	baseURL string
+	key     string
+}
+
+func (p *openCriticProvider) Name() string { return "opencritic" }
+
+func (p *openCriticProvider) get(ctx context.Context, path string, data interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("X-RapidAPI-Key", p.key)
+	req.Header.Add("Accept", "application/json")
+	return doJSON(req, data)
+}
+
+func (p *openCriticProvider) Rating(ctx context.Context, game string) (string, error) {
+	var results []struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	if err := p.get(ctx, "/game/search?"+url.Values{"criteria": {game}}.Encode(), &results); err != nil {
+		return "", err
+	}
+	for _, r := range results {
+		if !strings.EqualFold(r.Name, game) {
+			continue
+		}
+		var g struct {
+			TopCriticScore float64 `json:"topCriticScore"`
+		}
+		if err := p.get(ctx, fmt.Sprintf("/game/%d", r.ID), &g); err != nil {
+			return "", err
+		}
+		// OpenCritic reports -1 until enough reviews are in
+		if g.TopCriticScore <= 0 {
+			return "", nil
+		}
+		return fmt.Sprintf("%d/100", int(math.Round(g.TopCriticScore))), nil
+	}
+	return "", nil
+}
+
+func doJSON(req *http.Request, data interface{}) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(data)
+}
+
+// cachedRating is what's persisted in ratings.json
+type cachedRating struct {
+	Rating  string    `json:"rating"`
+	Fetched time.Time `json:"fetched"`
+}
+
+func (c cachedRating) fresh() bool {
+	ttl := ratingTTL
+	if c.Rating == "" {
+		ttl = noRatingTTL
+	}
+	return time.Since(c.Fetched) < ttl
+}
+
+var ratings = struct {
+	sync.Mutex
+	provider RatingProvider
+	cache    Storage
+	inflight map[string]chan struct{}
+}{inflight: make(map[string]chan struct{})}
+
+func init() {
+	chain := ratingChain{}
+	if CLIENT_ID != "" && CLIENT_SECRET != "" {
+		chain = append(chain, &igdbProvider{IGDB_URL})
+	}
+	if RAPIDAPI_KEY != "" {
+		chain = append(chain, &openCriticProvider{OPENCRITIC_URL, RAPIDAPI_KEY})
+	}
+	ratings.provider = chain
+	ratings.cache = Store("ratings")
+}
+
+// getRating adds a rating to the game's name if one can be found quickly.
+// Slow lookups carry on in the background and are cached for next time.
+func getRating(game string) string {
+	if game == "" {
+		return game
+	}
+	key := strings.ToLower(game)
+
+	var c cachedRating
+	if ratings.cache.Load(key, &c) && c.fresh() {
+		return formatRating(game, c.Rating)
+	}
+
+	ratings.Lock()
+	done, ok := ratings.inflight[key]
+	if !ok {
+		done = make(chan struct{})
+		ratings.inflight[key] = done
+		go lookupRating(game, key, done)
+	}
+	ratings.Unlock()
+
+	select {
+	case <-done:
+		ratings.cache.Load(key, &c)
+	case <-time.After(ratingTimeout):
+	}
+	return formatRating(game, c.Rating)
+}
+
+func lookupRating(game, key string, done chan struct{}) {
+	defer func() {
+		ratings.Lock()
+		delete(ratings.inflight, key)
+		ratings.Unlock()
+		close(done)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), providerBudget)
+	defer cancel()
+	r, err := ratings.provider.Rating(ctx, game)
+	if err != nil {
+		// Don't cache failures, the API may be back next time
+		return
+	}
+	if err := ratings.cache.Put(key, cachedRating{r, time.Now()}); err != nil {
+		log.Printf("Failed to cache rating for %q: %v", game, err)
+	}
+}
+
+func formatRating(game, rating string) string {
+	if rating == "" {
+		return game
+	}
+	return fmt.Sprintf("%s [Rating: %s]", game, rating)
+}
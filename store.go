@@ -1,75 +1,221 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"log"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
-	"fmt"
 )
 
-type store struct {
+// Storage is a set of key -> value pairs. Values are usually plain strings,
+// but Load and Put allow storing structured records alongside them.
+type Storage interface {
+	Get(key string) (string, bool)
+	Load(key string, v interface{}) bool
+	Keys() []string
+	Random(query string) string
+
+	Add(key, value string) error
+	Put(key string, value interface{}) error
+	Append(value interface{}) (string, error)
+	Remove(key string) error
+	Blank(key string) (bool, error)
+
+	Begin() *Tx
+}
+
+// Storage backends, picked with BOT_STORAGE
+const (
+	storageJSON   = "json"
+	storageBolt   = "bolt"
+	storageMemory = "memory"
+)
+
+// File extensions used by the backends that write to disk
+var storeExts = map[string]string{storageJSON: ".json", storageBolt: ".db"}
+
+// Store opens the named store with the configured backend
+func Store(name string) Storage {
+	return openStore(STORAGE, name)
+}
+
+// AppendOnlyStore opens a store that only ever grows, like the ledger. It's
+// kept in bbolt whatever BOT_STORAGE says, since the JSON backend would
+// rewrite the whole, ever larger, file on every change. A JSON copy left
+// from before is moved over first.
+func AppendOnlyStore(name string) Storage {
+	if STORAGE == storageMemory {
+		return newMemStore()
+	}
+	if _, err := os.Stat(name + storeExts[storageJSON]); err == nil {
+		s, err := migrateStore(name)
+		must(err)
+		return s
+	}
+	return openStore(storageBolt, name)
+}
+
+func openStore(backend, name string) Storage {
+	if backend != storageMemory {
+		must(checkBackend(backend, name))
+	}
+	return newStore(backend, name)
+}
+
+func newStore(backend, name string) Storage {
+	switch backend {
+	case storageJSON:
+		return newJSONStore(name + storeExts[storageJSON])
+	case storageBolt:
+		return newBoltStore(name + storeExts[storageBolt])
+	case storageMemory:
+		return newMemStore()
+	}
+	log.Fatalf("Unknown storage backend %q, expected %s, %s or %s", backend, storageJSON, storageBolt, storageMemory)
+	return nil
+}
+
+// checkBackend refuses to open a store whose data is in another backend's
+// file, so starting with the wrong BOT_STORAGE, say after kaet migrate,
+// doesn't quietly carry on from an empty store.
+func checkBackend(backend, name string) error {
+	for other, ext := range storeExts {
+		if other == backend {
+			continue
+		}
+		if _, err := os.Stat(name + ext); err == nil {
+			return fmt.Errorf("%s%s exists but BOT_STORAGE is %s, set it to %s or run kaet migrate", name, ext, backend, other)
+		}
+	}
+	if backend == storageJSON {
+		if _, err := os.Stat(name + ".json.migrated"); err == nil {
+			return fmt.Errorf("%s was migrated out of JSON, set BOT_STORAGE to the backend it was migrated to", name)
+		}
+	}
+	return nil
+}
+
+// memStore keeps everything in memory. The file backends embed it and set
+// save to persist each change.
+type memStore struct {
 	sync.RWMutex
-	name string
-	file *os.File
-	data map[string]string
+	data map[string]json.RawMessage
+
+	// save is called with the lock held after changes have been applied to
+	// data. A nil value in changes is a removal.
+	save func(changes map[string]json.RawMessage) error
 }
 
-func Store(name string) *store {
-	f, err := os.OpenFile(name+".json", os.O_RDWR|os.O_CREATE, 0666)
-	must(err)
-	s := &store{
-		name: name,
-		file: f,
-		data: make(map[string]string),
+func newMemStore() *memStore {
+	return &memStore{data: make(map[string]json.RawMessage)}
+}
+
+// set applies changes and saves them, putting the old values back if the
+// save fails so memory never gets ahead of disk.
+func (s *memStore) set(changes map[string]json.RawMessage) error {
+	old := make(map[string]json.RawMessage, len(changes))
+	for k, v := range changes {
+		old[k] = s.data[k]
+		if v == nil {
+			delete(s.data, k)
+		} else {
+			s.data[k] = v
+		}
 	}
-	json.NewDecoder(f).Decode(&s.data)
-	return s
+	if s.save == nil {
+		return nil
+	}
+	if err := s.save(changes); err != nil {
+		for k, v := range old {
+			if v == nil {
+				delete(s.data, k)
+			} else {
+				s.data[k] = v
+			}
+		}
+		return err
+	}
+	return nil
 }
 
-func (s *store) save() {
-	s.file.Truncate(0)
-	s.file.Seek(0, 0)
-	json.NewEncoder(s.file).Encode(s.data)
-	s.file.Sync()
+func (s *memStore) setOne(key string, value json.RawMessage) error {
+	return s.set(map[string]json.RawMessage{key: value})
+}
+
+func encodeString(v string) json.RawMessage {
+	b, _ := json.Marshal(v)
+	return b
+}
+
+func decodeString(raw json.RawMessage) (string, bool) {
+	var v string
+	err := json.Unmarshal(raw, &v)
+	return v, err == nil
 }
 
 // WRITE
-func (s *store) Add(key string, value string) {
+func (s *memStore) Add(key string, value string) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.setOne(key, encodeString(value))
+}
+func (s *memStore) Put(key string, value interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
 	s.Lock()
 	defer s.Unlock()
-	s.data[key] = value
-	s.save()
+	return s.setOne(key, b)
 }
-func (s *store) Append(value string) {
+func (s *memStore) Append(value interface{}) (string, error) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
 	s.Lock()
 	defer s.Unlock()
-	s.data[strconv.Itoa(len(s.data))] = value
-	s.save()
+	// Numbering carries on from the highest key, so removals don't cause reuse
+	next := 0
+	for k := range s.data {
+		if n, err := strconv.Atoi(k); err == nil && n >= next {
+			next = n + 1
+		}
+	}
+	key := strconv.Itoa(next)
+	return key, s.setOne(key, b)
 }
-func (s *store) Remove(key string) {
+func (s *memStore) Remove(key string) error {
 	s.Lock()
 	defer s.Unlock()
-	delete(s.data, key)
-	s.save()
+	if _, ok := s.data[key]; !ok {
+		return nil
+	}
+	return s.setOne(key, nil)
 }
-func (s *store) Blank(key string) bool {
+
+func (s *memStore) Blank(key string) (bool, error) {
 	s.Lock()
 	defer s.Unlock()
 	val, found := s.data[key]
-	doBlank := found && val != ""
+	doBlank := found && string(val) != `""`
 	if doBlank {
-		s.data[key] = ""
-		s.save()
+		if err := s.setOne(key, encodeString("")); err != nil {
+			return false, err
+		}
 	}
-	return doBlank
+	return doBlank, nil
 }
 
 // READ
-func (s *store) Keys() []string {
+func (s *memStore) Keys() []string {
 	s.RLock()
 	defer s.RUnlock()
 	keys := make([]string, 0, len(s.data))
@@ -79,25 +225,181 @@ func (s *store) Keys() []string {
 	sort.Sort(sort.StringSlice(keys))
 	return keys
 }
-func (s *store) Get(key string) (string, bool) {
+func (s *memStore) Get(key string) (string, bool) {
 	s.RLock()
 	defer s.RUnlock()
-	v, ok := s.data[key]
-	return v, ok
+	raw, ok := s.data[key]
+	return getString(raw, ok)
 }
-func (s *store) Random(query string) string {
+
+func (s *memStore) Random(query string) string {
 	query = strings.ToLower(query)
 	s.RLock()
 	defer s.RUnlock()
 	keys := make([]string, 0, len(s.data))
-	for k, v := range s.data {
+	values := make([]string, 0, len(s.data))
+	for k, raw := range s.data {
+		v, _ := decodeString(raw)
 		if v != "" && (query == "" || strings.Contains(strings.ToLower(v), query)) {
 			keys = append(keys, k)
+			values = append(values, v)
 		}
 	}
 	if len(keys) == 0 {
 		return "None Found"
 	}
-	selectedKey := keys[rand.Intn(len(keys))]
-	return fmt.Sprintf("%s #%s", s.data[selectedKey], selectedKey)
+	i := rand.Intn(len(keys))
+	return fmt.Sprintf("%s #%s", values[i], keys[i])
+}
+
+// getString returns string values as they are and anything else as JSON
+func getString(raw json.RawMessage, ok bool) (string, bool) {
+	if !ok {
+		return "", false
+	}
+	if v, isString := decodeString(raw); isString {
+		return v, true
+	}
+	return string(raw), true
+}
+
+// Load decodes the value at key into v, reporting false if it's missing or
+// doesn't match v's type.
+func (s *memStore) Load(key string, v interface{}) bool {
+	s.RLock()
+	defer s.RUnlock()
+	raw, ok := s.data[key]
+	return ok && json.Unmarshal(raw, v) == nil
+}
+
+// Tx is a set of changes to one store that are saved together, with a single
+// write, or not at all. The store stays locked from Begin until Commit or
+// Rollback, so nothing read through the Tx can change underneath it. Don't
+// use the store itself while a Tx is open.
+type Tx struct {
+	s       *memStore
+	changes map[string]json.RawMessage
+	done    bool
+}
+
+func (s *memStore) Begin() *Tx {
+	s.Lock()
+	return &Tx{s: s, changes: make(map[string]json.RawMessage)}
+}
+
+// Get sees the Tx's own changes as well as what's already stored
+func (tx *Tx) Get(key string) (string, bool) {
+	raw, ok := tx.changes[key]
+	if !ok {
+		raw, ok = tx.s.data[key]
+	}
+	return getString(raw, ok && raw != nil)
+}
+func (tx *Tx) Load(key string, v interface{}) bool {
+	raw, ok := tx.changes[key]
+	if !ok {
+		raw, ok = tx.s.data[key]
+	}
+	return ok && raw != nil && json.Unmarshal(raw, v) == nil
+}
+func (tx *Tx) Add(key, value string) {
+	tx.changes[key] = encodeString(value)
+}
+func (tx *Tx) Put(key string, value interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	tx.changes[key] = b
+	return nil
+}
+func (tx *Tx) Remove(key string) {
+	tx.changes[key] = nil
+}
+
+// Commit saves every change, or none of them if it fails
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return fmt.Errorf("transaction already finished")
+	}
+	tx.done = true
+	defer tx.s.Unlock()
+	if len(tx.changes) == 0 {
+		return nil
+	}
+	return tx.s.set(tx.changes)
+}
+
+// Rollback drops the changes. It does nothing after Commit, so it can always
+// be deferred.
+func (tx *Tx) Rollback() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	tx.s.Unlock()
+}
+
+// jsonStore is a single JSON file, rewritten in full on every change
+type jsonStore struct {
+	*memStore
+	path string
+}
+
+// newJSONStore loads path, refusing to start if it exists but can't be read
+// so a damaged file is never silently replaced with an empty one.
+func newJSONStore(path string) *jsonStore {
+	s := &jsonStore{newMemStore(), path}
+	s.save = func(map[string]json.RawMessage) error {
+		return writeFileAtomic(s.path, func(f *os.File) error {
+			return json.NewEncoder(f).Encode(s.data)
+		})
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Can't read %s: %v", path, err)
+	}
+	if len(bytes.TrimSpace(b)) > 0 {
+		if err := json.Unmarshal(b, &s.data); err != nil {
+			log.Fatalf("%s is corrupt, refusing to start: %v", path, err)
+		}
+	}
+	return s
+}
+
+// writeFileAtomic writes to a temp file and renames it over path, so a crash
+// part way through leaves the previous version intact.
+func writeFileAtomic(path string, write func(*os.File) error) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, base+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("writing %s: %v", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("syncing %s: %v", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing %s: %v", path, err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+
+	// Make the rename itself durable
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
 }
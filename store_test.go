@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAppendAfterRemove(t *testing.T) {
+	s := newMemStore()
+	for _, v := range []string{"a", "b", "c"} {
+		if _, err := s.Append(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Remove("0")
+	key, err := s.Append("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "3" {
+		t.Errorf("Append after Remove used key %q, want 3", key)
+	}
+	if v, _ := s.Get("2"); v != "c" {
+		t.Errorf("key 2 is %q, want c", v)
+	}
+}
+
+func TestTxRollsBackFailedSave(t *testing.T) {
+	s := newMemStore()
+	s.Add("a", "1")
+	s.save = func(map[string]json.RawMessage) error { return errors.New("disk full") }
+
+	tx := s.Begin()
+	tx.Add("a", "2")
+	tx.Add("b", "3")
+	if err := tx.Commit(); err == nil {
+		t.Fatal("Commit succeeded with a failing save")
+	}
+	if v, _ := s.Get("a"); v != "1" {
+		t.Errorf("a is %q after failed commit, want 1", v)
+	}
+	if _, ok := s.Get("b"); ok {
+		t.Error("b was kept after failed commit")
+	}
+}
+
+func TestBoltStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	s := newBoltStore(path)
+	s.Add("a", "1")
+	s.Put("b", map[string]int{"x": 1})
+	s.Remove("a")
+	tx := s.Begin()
+	tx.Add("c", "3")
+	tx.Add("d", "4")
+	tx.Commit()
+	s.Close()
+
+	s = newBoltStore(path)
+	defer s.Close()
+	if _, ok := s.Get("a"); ok {
+		t.Error("removed key came back")
+	}
+	if v, _ := s.Get("b"); v != `{"x":1}` {
+		t.Errorf("b is %q", v)
+	}
+	if v, _ := s.Get("d"); v != "4" {
+		t.Errorf("d is %q", v)
+	}
+}
+
+func TestRandomAndBlank(t *testing.T) {
+	s := newMemStore()
+	s.Append("the cake is a lie")
+	s.Append("hello world")
+
+	if v := s.Random("CAKE"); v != "the cake is a lie #0" {
+		t.Errorf("Random(CAKE) is %q", v)
+	}
+	if blanked, err := s.Blank("0"); !blanked || err != nil {
+		t.Errorf("Blank(0) = %v, %v", blanked, err)
+	}
+	if blanked, _ := s.Blank("0"); blanked {
+		t.Error("blanked an already blank key")
+	}
+	if v := s.Random("cake"); v != "None Found" {
+		t.Errorf("Random(cake) found %q after blanking it", v)
+	}
+}
+
+func TestOpenStoreChecksBackend(t *testing.T) {
+	dir := t.TempDir()
+	for name, file := range map[string]string{
+		"bolt file":     "test.db",
+		"migrated JSON": "test.json.migrated",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, file)
+			if err := os.WriteFile(path, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(path)
+			if err := checkBackend(storageJSON, filepath.Join(dir, "test")); err == nil {
+				t.Errorf("opened a JSON store next to %s", file)
+			}
+		})
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "test.json"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkBackend(storageBolt, filepath.Join(dir, "test")); err == nil {
+		t.Error("opened a bolt store next to an unmigrated JSON file")
+	}
+	if err := checkBackend(storageJSON, filepath.Join(dir, "test")); err != nil {
+		t.Errorf("refused the JSON store itself: %v", err)
+	}
+}
+
+func TestAppendOnlyStoreMovesJSON(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "ledger")
+	old := newJSONStore(name + ".json")
+	old.Add("0000000000", "entry")
+
+	s := AppendOnlyStore(name)
+	defer s.(*boltStore).Close()
+	if v, _ := s.Get("0000000000"); v != "entry" {
+		t.Errorf("entry is %q after moving to bbolt, want entry", v)
+	}
+	if _, err := os.Stat(name + ".db"); err != nil {
+		t.Errorf("no bolt file: %v", err)
+	}
+	if _, err := os.Stat(name + ".json"); !os.IsNotExist(err) {
+		t.Errorf("JSON file was left in place: %v", err)
+	}
+}
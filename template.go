@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// Custom command responses and welcomes can contain $(name args...) variables
+// which are filled in each time they are sent.
+
+type templatePart struct {
+	text string
+	fn   string
+	args []string
+	run  func(t *templateContext, args []string) string
+}
+
+type templateFunc struct {
+	minArgs int
+	maxArgs int
+	check   func(args []string) error
+	run     func(t *templateContext, args []string) string
+}
+
+type templateContext struct {
+	ch   *channel
+	user *User
+	args string
+	vars map[string]string // details of the event a welcome is for
+}
+
+var templateFuncs map[string]templateFunc
+
+func init() {
+	templateFuncs = map[string]templateFunc{
+		"user": {0, 0, nil, func(t *templateContext, _ []string) string {
+			return t.user.Name
+		}},
+		"touser": {0, 0, nil, func(t *templateContext, _ []string) string {
+			if v := strings.TrimPrefix(split(t.args, 2)[0], "@"); v != "" {
+				return v
+			}
+			return t.user.Name
+		}},
+		"args": {0, 1, checkArgIndex, func(t *templateContext, args []string) string {
+			if len(args) == 0 {
+				return t.args
+			}
+			n, _ := strconv.Atoi(args[0])
+			words := strings.Fields(t.args)
+			if n > len(words) {
+				return ""
+			}
+			return words[n-1]
+		}},
+		"uptime": {0, 0, nil, func(t *templateContext, _ []string) string {
+			return getUptime(t.ch)
+		}},
+		"game": {0, 0, nil, func(t *templateContext, _ []string) string {
+			return getGame(t.ch, false)
+		}},
+		"count": {1, 1, nil, func(t *templateContext, args []string) string {
+			v, _ := t.ch.counters.Get(strings.ToLower(args[0]))
+			if v == "" {
+				v = "0"
+			}
+			return v
+		}},
+		"random": {2, 2, checkRandom, func(_ *templateContext, args []string) string {
+			lo, _ := strconv.Atoi(args[0])
+			hi, _ := strconv.Atoi(args[1])
+			return strconv.Itoa(lo + rand.Intn(hi-lo+1))
+		}},
+		"quote": {0, 0, nil, func(t *templateContext, _ []string) string {
+			return randomQuote(t.ch, "")
+		}},
+		"balance": {0, 0, nil, func(t *templateContext, _ []string) string {
+			return strconv.Itoa(t.ch.ledger.Balance(t.user.ID))
+		}},
+	}
+}
+
+func checkArgIndex(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	if n, err := strconv.Atoi(args[0]); err != nil || n < 1 {
+		return fmt.Errorf("$(args %s) needs a position starting at 1", args[0])
+	}
+	return nil
+}
+
+func checkRandom(args []string) error {
+	lo, err1 := strconv.Atoi(args[0])
+	hi, err2 := strconv.Atoi(args[1])
+	if err1 != nil || err2 != nil || lo > hi {
+		return fmt.Errorf("$(random %s %s) needs two whole numbers, smallest first", args[0], args[1])
+	}
+	// Keeps hi-lo+1 from overflowing when the command runs
+	if lo < math.MinInt32 || hi > math.MaxInt32 || hi-lo >= math.MaxInt32 {
+		return fmt.Errorf("$(random %s %s) is too big a range", args[0], args[1])
+	}
+	return nil
+}
+
+// parseTemplate splits s into text and variables, checking every variable
+// exists and has sensible arguments.
+func parseTemplate(s string) ([]templatePart, error) {
+	return parseTemplateFuncs(s, templateFuncs)
+}
+
+// parseTemplateFuncs is parseTemplate with its own set of variables
+func parseTemplateFuncs(s string, funcs map[string]templateFunc) ([]templatePart, error) {
+	parts := []templatePart{}
+	for s != "" {
+		i := strings.Index(s, "$(")
+		if i < 0 {
+			parts = append(parts, templatePart{text: s})
+			break
+		}
+		if i > 0 {
+			parts = append(parts, templatePart{text: s[:i]})
+		}
+		s = s[i+2:]
+
+		j := strings.IndexByte(s, ')')
+		if j < 0 {
+			return nil, fmt.Errorf("missing ) after $(")
+		}
+		fields := strings.Fields(s[:j])
+		s = s[j+1:]
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("empty $()")
+		}
+
+		name, args := strings.ToLower(fields[0]), fields[1:]
+		fn, ok := funcs[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown variable $(%s)", name)
+		}
+		if len(args) < fn.minArgs || len(args) > fn.maxArgs {
+			return nil, fmt.Errorf("wrong number of arguments for $(%s)", name)
+		}
+		if fn.check != nil {
+			if err := fn.check(args); err != nil {
+				return nil, err
+			}
+		}
+		parts = append(parts, templatePart{fn: name, args: args, run: fn.run})
+	}
+	return parts, nil
+}
+
+func executeTemplate(parts []templatePart, t *templateContext) string {
+	b := strings.Builder{}
+	for _, p := range parts {
+		if p.fn == "" {
+			b.WriteString(p.text)
+			continue
+		}
+		b.WriteString(p.run(t, p.args))
+	}
+	return b.String()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckRandom(t *testing.T) {
+	for _, tt := range []struct {
+		lo, hi string
+		ok     bool
+	}{
+		{"1", "6", true},
+		{"-10", "10", true},
+		{"5", "5", true},
+		{"0", "2147483646", true},
+		{"6", "1", false},
+		{"a", "6", false},
+		{"0", "9223372036854775807", false},
+		{"-9223372036854775808", "0", false},
+		{"-2147483648", "2147483647", false},
+	} {
+		err := checkRandom([]string{tt.lo, tt.hi})
+		if (err == nil) != tt.ok {
+			t.Errorf("checkRandom(%s, %s) = %v", tt.lo, tt.hi, err)
+			continue
+		}
+		if err == nil {
+			// Must not panic
+			parts, err := parseTemplate("$(random " + tt.lo + " " + tt.hi + ")")
+			if err != nil {
+				t.Fatal(err)
+			}
+			executeTemplate(parts, &templateContext{})
+		}
+	}
+}
+
+func TestWelcomeTemplates(t *testing.T) {
+	for event, tmpl := range defaultWelcomes {
+		if _, err := parseTemplateFuncs(tmpl, welcomeFuncs(event)); err != nil {
+			t.Errorf("default %s welcome doesn't parse: %v", event, err)
+		}
+	}
+
+	ch := &channel{welcomes: newMemStore()}
+	if resp := cmdWelcome(ch, nil, "resub Thanks for $(mounths) months!"); !strings.HasPrefix(resp, "Can't set") {
+		t.Errorf("typo was accepted: %q", resp)
+	}
+	if resp := cmdWelcome(ch, nil, "sub $(user) has been here $(months) months"); !strings.HasPrefix(resp, "Can't set") {
+		t.Errorf("another event's variable was accepted: %q", resp)
+	}
+	if _, ok := ch.welcomes.Get("resub"); ok {
+		t.Error("a bad welcome was saved")
+	}
+
+	cmdWelcome(ch, nil, "resub Thanks $(user) for $(months) months!")
+	out := newOutbox()
+	handleUserNotice(out, ch, &message{MsgID: "resub", DisplayName: "Viewer", Args: []string{"#test"},
+		Tags: map[string]string{"msg-param-cumulative-months": "7"}})
+	m, err := parse([]byte(<-out.queue))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "\u200BThanks Viewer for 7 months!"; m.Args[1] != want {
+		t.Errorf("welcome is %q, want %q", m.Args[1], want)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const timerTick = 30 * time.Second
+
+// timer is a message posted every Interval while the stream is live, as long
+// as at least MinLines of chat have happened since it last posted.
+type timer struct {
+	Interval   time.Duration `json:"interval"`
+	MinLines   int64         `json:"min_lines"`
+	Message    string        `json:"message"`
+	Paused     bool          `json:"paused"`
+	LastPosted time.Time     `json:"last_posted"`
+}
+
+// countLine records a line of chat for the timers' activity check
+func (ch *channel) countLine() {
+	atomic.AddInt64(&ch.lines, 1)
+}
+
+func init() {
+	// Give chat a full interval after going live before timers start posting
+	subscribe(func(e streamEvent) {
+		if e.Kind != eventLive {
+			return
+		}
+		ch := e.Channel
+		ch.timerLock.Lock()
+		defer ch.timerLock.Unlock()
+		for _, name := range ch.timers.Keys() {
+			var t timer
+			if ch.timers.Load(name, &t) {
+				t.LastPosted = time.Now()
+				if err := ch.timers.Put(name, t); err != nil {
+					log.Printf("Failed to save timer %s: %v", name, err)
+				}
+			}
+		}
+	})
+}
+
+func runTimers(out *outbox) {
+	for range time.Tick(timerTick) {
+		channels.Lock()
+		list := make([]*channel, 0, len(channels.m))
+		for _, ch := range channels.m {
+			list = append(list, ch)
+		}
+		channels.Unlock()
+
+		for _, ch := range list {
+			runChannelTimers(out, ch)
+		}
+	}
+}
+
+func runChannelTimers(out *outbox, ch *channel) {
+	if !ch.Stream().Live {
+		return
+	}
+
+	ch.timerLock.Lock()
+	defer ch.timerLock.Unlock()
+
+	now := time.Now()
+	lines := atomic.LoadInt64(&ch.lines)
+	due := []string{}
+	for _, name := range ch.timers.Keys() {
+		var t timer
+		if !ch.timers.Load(name, &t) || t.Paused || now.Sub(t.LastPosted) < t.Interval {
+			continue
+		}
+		if lines-ch.timerLines[name] < t.MinLines {
+			continue
+		}
+		due = append(due, name)
+	}
+	if len(due) == 0 {
+		return
+	}
+	// Post at most one timer per tick so they don't arrive in a clump
+	sort.Slice(due, func(i, j int) bool {
+		var a, b timer
+		ch.timers.Load(due[i], &a)
+		ch.timers.Load(due[j], &b)
+		return a.LastPosted.Before(b.LastPosted)
+	})
+	name := due[0]
+	var t timer
+	ch.timers.Load(name, &t)
+	t.LastPosted = now
+	// Skip posting rather than risk repeating the message every tick
+	if err := ch.timers.Put(name, t); err != nil {
+		log.Printf("Failed to save timer %s: %v", name, err)
+		return
+	}
+	ch.timerLines[name] = lines
+
+	msg := t.Message
+	if parts, err := parseTemplate(msg); err == nil {
+		msg = executeTemplate(parts, &templateContext{ch, &User{Name: USER, Login: USER, Level: levelModerator}, "", nil})
+	}
+	log.Printf("Posting timer %s in %s", name, ch.Name)
+	out.Say("#"+ch.Name, msg)
+}
+
+func cmdTimer(ch *channel, _ *User, data string) string {
+	const usage = "Usage: !timer add <name> <interval> <min lines> <message>, !timer remove|pause|resume <name>, !timer list"
+	v := split(data, 3)
+	action, name := v[0], strings.ToLower(v[1])
+
+	ch.timerLock.Lock()
+	defer ch.timerLock.Unlock()
+
+	var t timer
+	exists := name != "" && ch.timers.Load(name, &t)
+
+	switch action {
+	case "add":
+		p := strings.SplitN(strings.TrimSpace(v[2]), " ", 3)
+		if name == "" || len(p) < 3 || strings.TrimSpace(p[2]) == "" {
+			return usage
+		}
+		interval, err := time.ParseDuration(p[0])
+		if err != nil || interval < time.Minute {
+			return "Invalid interval, use something like 15m (at least 1m)"
+		}
+		minLines, err := strconv.ParseInt(p[1], 10, 64)
+		if err != nil || minLines < 0 {
+			return "Invalid minimum number of chat lines"
+		}
+		if _, err := parseTemplate(p[2]); err != nil {
+			return fmt.Sprintf("Can't add timer %s: %s", name, err)
+		}
+		// Don't fire straight away, give chat a full interval first
+		if err := ch.timers.Put(name, timer{interval, minLines, p[2], false, time.Now()}); err != nil {
+			return errSaving(err)
+		}
+		ch.timerLines[name] = atomic.LoadInt64(&ch.lines)
+		if exists {
+			return fmt.Sprintf("Updated timer %s", name)
+		}
+		return fmt.Sprintf("Added timer %s, posting every %s after %d lines of chat", name, interval, minLines)
+
+	case "remove", "del", "delete":
+		if !exists {
+			return fmt.Sprintf("There's no timer called %q", name)
+		}
+		if err := ch.timers.Remove(name); err != nil {
+			return errSaving(err)
+		}
+		delete(ch.timerLines, name)
+		return fmt.Sprintf("Removed timer %s", name)
+
+	case "pause", "resume":
+		if !exists {
+			return fmt.Sprintf("There's no timer called %q", name)
+		}
+		t.Paused = action == "pause"
+		if err := ch.timers.Put(name, t); err != nil {
+			return errSaving(err)
+		}
+		return fmt.Sprintf("Timer %s %sd", name, action)
+
+	case "list":
+		names := ch.timers.Keys()
+		if len(names) == 0 {
+			return "No timers"
+		}
+		list := []string{}
+		for _, name := range names {
+			ch.timers.Load(name, &t)
+			entry := fmt.Sprintf("%s (%s, %d lines", name, t.Interval, t.MinLines)
+			if t.Paused {
+				entry += ", paused"
+			}
+			list = append(list, entry+")")
+		}
+		return "Timers: " + strings.Join(list, ", ")
+	}
+
+	return usage
+}
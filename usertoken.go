@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scopes asked of broadcasters when they authorize the bot
+var broadcasterScopes = []string{"channel:manage:broadcast", "moderator:read:followers"}
+
+var errNoUserToken = errors.New("the broadcaster hasn't authorized the bot yet")
+
+// userToken is a broadcaster's OAuth token, kept separate from the bot's
+// chat token since it acts on the broadcaster's behalf.
+type userToken struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	Expires      time.Time `json:"expires"`
+	Scopes       []string  `json:"scopes"`
+}
+
+// broadcasterToken is a tokenSource for the channel's broadcaster, refreshing
+// the stored token when it expires or is rejected.
+func (ch *channel) broadcasterToken(force bool) (string, error) {
+	ch.authLock.Lock()
+	defer ch.authLock.Unlock()
+
+	var t userToken
+	if !ch.auth.Load("broadcaster", &t) {
+		return "", errNoUserToken
+	}
+	if !force && time.Now().Before(t.Expires) {
+		return t.AccessToken, nil
+	}
+
+	q := url.Values{
+		"client_id":     {CLIENT_ID},
+		"client_secret": {CLIENT_SECRET},
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {t.RefreshToken},
+	}
+	t, err := requestUserToken(q)
+	if err != nil {
+		return "", fmt.Errorf("refreshing %s's token: %s", ch.Name, err)
+	}
+	// The old refresh token may already be spent, so a failed save is fatal to the token
+	if err := ch.auth.Put("broadcaster", t); err != nil {
+		return "", err
+	}
+	return t.AccessToken, nil
+}
+
+func requestUserToken(q url.Values) (userToken, error) {
+	resp, err := http.PostForm(OAUTH_URL+"/token", q)
+	if err != nil {
+		return userToken{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return userToken{}, fmt.Errorf("token request: %s", resp.Status)
+	}
+
+	var data struct {
+		AccessToken  string   `json:"access_token"`
+		RefreshToken string   `json:"refresh_token"`
+		ExpiresIn    int      `json:"expires_in"`
+		Scope        []string `json:"scope"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return userToken{}, err
+	}
+	return userToken{
+		AccessToken:  data.AccessToken,
+		RefreshToken: data.RefreshToken,
+		Expires:      time.Now().Add(time.Duration(data.ExpiresIn)*time.Second - tokenExpiryMargin),
+		Scopes:       data.Scope,
+	}, nil
+}
+
+// validateUserToken asks Twitch who a token belongs to
+func validateUserToken(token string) (string, error) {
+	req, err := http.NewRequest("GET", OAUTH_URL+"/validate", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("Authorization", "OAuth "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("validate: %s", resp.Status)
+	}
+
+	var data struct {
+		UserID string `json:"user_id"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	return data.UserID, err
+}
+
+// OAuth states handed out by /auth/twitch and not yet used
+var authStates = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+const authStateLifetime = 10 * time.Minute
+
+func init() {
+	http.HandleFunc("/auth/twitch", authStart)
+	http.HandleFunc("/auth/callback", authCallback)
+}
+
+// authStart sends the broadcaster to Twitch to authorize the bot
+func authStart(w http.ResponseWriter, r *http.Request) {
+	if REDIRECT_URL == "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "BOT_REDIRECT_URL isn't configured")
+		return
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Couldn't generate state")
+		return
+	}
+	state := hex.EncodeToString(b)
+
+	authStates.Lock()
+	for s, t := range authStates.m {
+		if time.Since(t) > authStateLifetime {
+			delete(authStates.m, s)
+		}
+	}
+	authStates.m[state] = time.Now()
+	authStates.Unlock()
+
+	q := url.Values{
+		"client_id":     {CLIENT_ID},
+		"redirect_uri":  {REDIRECT_URL},
+		"response_type": {"code"},
+		"scope":         {strings.Join(broadcasterScopes, " ")},
+		"state":         {state},
+	}
+	http.Redirect(w, r, OAUTH_URL+"/authorize?"+q.Encode(), http.StatusFound)
+}
+
+// authCallback stores the broadcaster's token against their channel
+func authCallback(w http.ResponseWriter, r *http.Request) {
+	state, code := r.URL.Query().Get("state"), r.URL.Query().Get("code")
+
+	authStates.Lock()
+	issued, ok := authStates.m[state]
+	delete(authStates.m, state)
+	authStates.Unlock()
+	if !ok || time.Since(issued) > authStateLifetime {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "Invalid or expired state, please try again")
+		return
+	}
+	if code == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "Authorization was declined")
+		return
+	}
+
+	t, err := requestUserToken(url.Values{
+		"client_id":     {CLIENT_ID},
+		"client_secret": {CLIENT_SECRET},
+		"code":          {code},
+		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {REDIRECT_URL},
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "Error getting token: %s\n", err)
+		return
+	}
+	userID, err := validateUserToken(t.AccessToken)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "Error checking token: %s\n", err)
+		return
+	}
+
+	channels.Lock()
+	ch, ok := channels.m[userID]
+	channels.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "The bot isn't in your channel")
+		return
+	}
+
+	ch.authLock.Lock()
+	err = ch.auth.Put("broadcaster", t)
+	ch.authLock.Unlock()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error saving token: %s\n", err)
+		return
+	}
+	log.Printf("Stored broadcaster token for %s", ch.Name)
+	fmt.Fprintf(w, "Thanks! The bot can now manage #%s\n", ch.Name)
+}
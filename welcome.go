@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Default welcome templates keyed on the USERNOTICE msg-id. Mods can override
+// them per channel with !welcome.
+var defaultWelcomes = map[string]string{
+	"sub":            "Welcome to the family $(user)! Thanks for the tier $(tier) sub!",
+	"resub":          "Welcome back $(user)! Thanks for $(months) months of tier $(tier) support!",
+	"subgift":        "$(gifter) gifted a tier $(tier) sub to $(recipient)! Welcome $(recipient)!",
+	"submysterygift": "$(gifter) is gifting $(count) tier $(tier) subs to the community! Thank you!",
+	"raid":           "$(raider) is raiding with $(viewers) viewers! Welcome raiders!",
+	"bitsbadgetier":  "$(user) just unlocked the $(threshold) bits badge!",
+}
+
+// welcomeVars are the details each event fills in
+var welcomeVars = map[string][]string{
+	"sub":            {"user", "tier"},
+	"resub":          {"user", "months", "tier"},
+	"subgift":        {"user", "gifter", "recipient", "tier"},
+	"submysterygift": {"user", "gifter", "count", "tier"},
+	"raid":           {"user", "raider", "viewers"},
+	"bitsbadgetier":  {"user", "threshold"},
+}
+
+// welcomeFuncs are the variables a welcome for event can use: the event's
+// details, plus the custom command variables that only need the channel.
+func welcomeFuncs(event string) map[string]templateFunc {
+	funcs := map[string]templateFunc{}
+	for _, name := range []string{"uptime", "game", "count", "random", "quote"} {
+		funcs[name] = templateFuncs[name]
+	}
+	for _, name := range welcomeVars[event] {
+		funcs[name] = templateFunc{0, 0, nil, func(t *templateContext, _ []string) string {
+			return t.vars[name]
+		}}
+	}
+	return funcs
+}
+
+func welcomeTemplate(ch *channel, event string) string {
+	if t, ok := ch.welcomes.Get(event); ok {
+		return t
+	}
+	return defaultWelcomes[event]
+}
+
+func handleUserNotice(out *outbox, ch *channel, m *message) {
+	event := m.MsgID
+	if _, ok := defaultWelcomes[event]; !ok {
+		return
+	}
+	// Each sub in a community gift gets its own subgift notice, the submysterygift covers them all
+	if event == "subgift" && m.Tags["msg-param-community-gift-id"] != "" {
+		return
+	}
+
+	tmpl := welcomeTemplate(ch, event)
+	if tmpl == "" {
+		return
+	}
+	parts, err := parseTemplateFuncs(tmpl, welcomeFuncs(event))
+	if err != nil {
+		// Saved before welcomes were checked, so fall back rather than post it broken
+		log.Printf("Bad %s welcome in %s: %v", event, ch.Name, err)
+		parts, _ = parseTemplateFuncs(defaultWelcomes[event], welcomeFuncs(event))
+	}
+
+	user := m.DisplayName
+	if user == "" {
+		user = m.Tags["login"]
+	}
+	vars := map[string]string{
+		"user":      user,
+		"months":    m.Tags["msg-param-cumulative-months"],
+		"tier":      subTier(m.Tags["msg-param-sub-plan"]),
+		"gifter":    user,
+		"recipient": m.Tags["msg-param-recipient-display-name"],
+		"count":     m.Tags["msg-param-mass-gift-count"],
+		"raider":    m.Tags["msg-param-displayName"],
+		"viewers":   m.Tags["msg-param-viewerCount"],
+		"threshold": m.Tags["msg-param-threshold"],
+	}
+	if vars["months"] == "" {
+		vars["months"] = "1"
+	}
+	if vars["raider"] == "" {
+		vars["raider"] = user
+	}
+
+	out.Say(m.Args[0], executeTemplate(parts, &templateContext{ch, nil, "", vars}))
+}
+
+func subTier(plan string) string {
+	switch plan {
+	case "Prime":
+		return "Prime"
+	case "2000":
+		return "2"
+	case "3000":
+		return "3"
+	}
+	return "1"
+}
+
+func cmdWelcome(ch *channel, _ *User, data string) string {
+	v := split(data, 2)
+	event, tmpl := v[0], strings.TrimSpace(v[1])
+
+	if _, ok := defaultWelcomes[event]; !ok {
+		events := []string{}
+		for k := range defaultWelcomes {
+			events = append(events, k)
+		}
+		sort.Strings(events)
+		return "Usage: !welcome <event> [message|off|default]. Events: " + strings.Join(events, " ")
+	}
+
+	switch strings.ToLower(tmpl) {
+	case "":
+		if t := welcomeTemplate(ch, event); t != "" {
+			return fmt.Sprintf("%s: %s", event, t)
+		}
+		return fmt.Sprintf("%s welcomes are off", event)
+	case "off":
+		if err := ch.welcomes.Add(event, ""); err != nil {
+			return errSaving(err)
+		}
+		return fmt.Sprintf("Turned off %s welcomes", event)
+	case "default":
+		if err := ch.welcomes.Remove(event); err != nil {
+			return errSaving(err)
+		}
+		return fmt.Sprintf("Reset %s welcome to the default", event)
+	}
+
+	if _, err := parseTemplateFuncs(tmpl, welcomeFuncs(event)); err != nil {
+		return fmt.Sprintf("Can't set the %s welcome: %s. It can use %s", event, err, welcomeVarList(event))
+	}
+	if err := ch.welcomes.Add(event, tmpl); err != nil {
+		return errSaving(err)
+	}
+	return fmt.Sprintf("Updated %s welcome", event)
+}
+
+// welcomeVarList lists the event's own variables, e.g. "$(user) $(tier)"
+func welcomeVarList(event string) string {
+	vars := []string{}
+	for _, name := range welcomeVars[event] {
+		vars = append(vars, "$("+name+")")
+	}
+	return strings.Join(vars, " ")
+}